@@ -2,19 +2,99 @@ package main
 
 import (
 	"antlion/app/proto"
+	"flag"
+	"log"
+	"net/http"
+	"os"
 	"sync"
 )
 
 func main() {
+	conf := proto.DefaultConfig()
+
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		keygen(conf, os.Args[2:])
+		return
+	}
+
+	flag.Var(&conf.SSHAddrs, "ssh-addr", "addresses the ssh server listens on, e.g. 0.0.0.0:2222,[::]:2222")
+	flag.Var(&conf.TelnetAddrs, "telnet-addr", "addresses the telnet server listens on")
+	flag.DurationVar(&conf.HandshakeTimeout, "handshake-timeout", conf.HandshakeTimeout, "time allowed for the protocol negotiation")
+	flag.DurationVar(&conf.AuthTimeout, "auth-timeout", conf.AuthTimeout, "time allowed for logging in")
+	flag.DurationVar(&conf.IdleTimeout, "idle-timeout", conf.IdleTimeout, "close sessions idle for this long")
+	flag.DurationVar(&conf.SessionTimeout, "session-timeout", conf.SessionTimeout, "close connections lasting this long")
+	flag.StringVar(&conf.HostKeyDir, "hostkey-dir", conf.HostKeyDir, "directory of the per persona ssh host keys")
+	flag.BoolVar(&conf.AcceptTCPIPForward, "accept-tcpip-forward", conf.AcceptTCPIPForward, "pretend that remote port forwarding (ssh -R) succeeds")
+	flag.Var(&conf.ForwardPolicy, "forward-policy", "direct-tcpip policy per destination port, e.g. default=reject,25=sink,80=emulate")
+	flag.IntVar(&conf.ForwardCaptureBytes, "forward-capture", conf.ForwardCaptureBytes, "bytes of tunneled traffic to keep per direct-tcpip channel")
+	flag.IntVar(&conf.MaxConns, "max-conns", conf.MaxConns, "open connections allowed in total, 0 for no limit")
+	flag.IntVar(&conf.MaxConnsPerIP, "max-conns-per-ip", conf.MaxConnsPerIP, "open connections allowed per source address, 0 for no limit")
+	flag.Float64Var(&conf.ConnRate, "conn-rate", conf.ConnRate, "new connections per second allowed per source address, 0 for no limit")
+	flag.IntVar(&conf.ConnBurst, "conn-burst", conf.ConnBurst, "new connections a source address may open at once, at least 1")
+	flag.Var(&conf.LimitAction, "limit-action", "what to do with connections over a limit: drop, tarpit or banner")
+	flag.IntVar(&conf.MaxTarpits, "max-tarpits", conf.MaxTarpits, "connections held by the tarpit at once")
+	flag.Var(&conf.TarpitCIDRs, "tarpit-cidr", "send connections from these networks to the tarpit, e.g. 192.0.2.0/24,198.51.100.7")
+	flag.Var(&conf.TarpitClients, "tarpit-client", "send ssh clients whose version matches this regexp to the tarpit, can be repeated")
+	flag.IntVar(&conf.TarpitAfter, "tarpit-after", conf.TarpitAfter, "send an address to the tarpit after this many connections, 0 for never")
+	flag.DurationVar(&conf.TarpitDelay, "tarpit-delay", conf.TarpitDelay, "time between two writes of the tarpit")
+	flag.DurationVar(&conf.TarpitTimeout, "tarpit-timeout", conf.TarpitTimeout, "let go of tarpitted clients after this long")
+	flag.Var(&conf.ProxyBackends, "proxy-backend", "relay authenticated ssh sessions to this server, user:password@host:port or host:port to pass the client's credentials on, can be repeated")
+	flag.Var(&conf.ProxyProtocol, "proxy-protocol", "PROXY protocol header before ssh and telnet: off, optional or required")
+	flag.Var(&conf.ProxyProtocolFrom, "proxy-protocol-from", "only believe PROXY headers from these networks, e.g. 10.0.0.0/8")
+	flag.IntVar(&conf.TelnetMaxTries, "telnet-max-tries", conf.TelnetMaxTries, "telnet logins tried before disconnecting, 0 for no limit")
+	flag.IntVar(&conf.TelnetAcceptAfter, "telnet-accept-after", conf.TelnetAcceptAfter, "accept the telnet login on this try, 0 for never")
+	flag.DurationVar(&conf.TelnetFailDelay, "telnet-fail-delay", conf.TelnetFailDelay, "wait this long before answering a failed telnet login")
+	flag.Var(&conf.TelnetLoginPrompt, "telnet-login-prompt", "telnet login prompt instead of the personas', e.g. \"Username: \", or of one as \"CentOS=Username: \", can be repeated")
+	flag.Var(&conf.TelnetPasswordPrompt, "telnet-password-prompt", "telnet password prompt instead of the personas', or of one as \"Debian=Password: \", can be repeated")
+	flag.StringVar(&conf.TelnetSignatures, "telnet-signatures", conf.TelnetSignatures, "file of known telnet client fingerprints, none when empty")
+	flag.Var(&conf.TelnetTLSAddrs, "telnets-addr", "addresses the telnet over TLS server listens on, e.g. :992, none by default")
+	flag.StringVar(&conf.TelnetTLSCert, "telnets-cert", conf.TelnetTLSCert, "PEM certificate of the telnet over TLS server, self-signed per persona when empty")
+	flag.StringVar(&conf.TelnetTLSKey, "telnets-key", conf.TelnetTLSKey, "PEM private key of -telnets-cert")
+	flag.StringVar(&conf.StatsAddr, "stats-addr", conf.StatsAddr, "address to serve the connection counters on at /debug/vars, e.g. 127.0.0.1:8080")
+	flag.Parse()
+
+	if conf.ConnRate > 0 && conf.ConnBurst < 1 {
+		// an empty bucket would refuse every connection
+		log.Fatal("-conn-burst must be at least 1 when -conn-rate is set")
+	}
+
+	if conf.StatsAddr != "" {
+		go func() {
+			// the counters are published through expvar on the default mux
+			log.Print("stats server failed:", http.ListenAndServe(conf.StatsAddr, nil))
+		}()
+	}
+
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
-		proto.StartTelnetServer()
+		proto.StartTelnetServer(conf)
 		wg.Done()
 	}()
 	go func() {
-		proto.StartSshSerer()
+		proto.StartSshSerer(conf)
 		wg.Done()
 	}()
 	wg.Wait()
 }
+
+// keygen creates the host keys of the personas ahead of the first start,
+// or imports an existing OpenSSH host key set for one of them.
+func keygen(conf *proto.Config, args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	dir := flags.String("hostkey-dir", conf.HostKeyDir, "directory of the per persona ssh host keys")
+	persona := flags.String("persona", "", "persona to create keys for, all of them when empty")
+	force := flags.Bool("force", false, "replace existing keys")
+	from := flags.String("import", "", "directory holding ssh_host_*_key files to import, such as /etc/ssh")
+	flags.Parse(args)
+
+	var err error
+	if *from != "" {
+		err = proto.ImportHostKeys(*dir, *persona, *from)
+	} else {
+		err = proto.GenerateHostKeys(*dir, *persona, *force)
+	}
+	if err != nil {
+		log.Fatal("keygen failed: ", err)
+	}
+}
@@ -0,0 +1,101 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// saveArtifact stores data captured during a session (scripts, uploads, ...)
+// next to the session log and records the file name in the log.
+func saveArtifact(logFile *os.File, kind string, data []byte) {
+	name := artifactName(logFile, kind)
+
+	err := ioutil.WriteFile(name, data, 0644)
+	if err != nil {
+		log.Print("failed to save artifact:", err.Error()+"\n")
+		return
+	}
+
+	fmt.Fprintf(logFile, "Artifact:%s %s (%d bytes)\n", kind, name, len(data))
+}
+
+// createArtifact is saveArtifact for data that is streamed as the session goes on.
+func createArtifact(logFile *os.File, kind string) (*os.File, error) {
+	name := artifactName(logFile, kind)
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(logFile, "Artifact:%s %s\n", kind, name)
+	return f, nil
+}
+
+func artifactName(logFile *os.File, kind string) string {
+	return strings.TrimSuffix(logFile.Name(), ".txt") + "-" + kind + "-" + strconv.FormatInt(time.Now().UnixNano(), 10) + ".bin"
+}
+
+// limitedBuffer keeps the first max bytes written to it and silently drops the rest,
+// so that captures can sit in a TeeReader without bounding what the client may send.
+type limitedBuffer struct {
+	data      []byte
+	max       int
+	truncated bool
+}
+
+func newLimitedBuffer(max int) *limitedBuffer {
+	return &limitedBuffer{
+		max: max,
+	}
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.max - len(b.data)
+	if room < len(p) {
+		b.truncated = true
+		if room < 0 {
+			room = 0
+		}
+		b.data = append(b.data, p[:room]...)
+		return len(p), nil
+	}
+
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+// limitedWriter is limitedBuffer for captures streamed to w as they come.
+type limitedWriter struct {
+	w         io.Writer
+	left      int
+	truncated bool
+}
+
+func newLimitedWriter(w io.Writer, max int) *limitedWriter {
+	return &limitedWriter{
+		w:    w,
+		left: max,
+	}
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > l.left {
+		l.truncated = true
+		p = p[:l.left]
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	l.left -= len(p)
+
+	_, err := l.w.Write(p)
+	return n, err
+}
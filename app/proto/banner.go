@@ -0,0 +1,95 @@
+package proto
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"regexp"
+	"text/template"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// personaBanner is the text sshd sends before authentication (the Banner
+// option of sshd_config). It is a text/template given bannerData.
+type personaBanner struct {
+	text *template.Template
+	// clients restricts the banner to the client versions matching one of
+	// these, every client sees it when empty.
+	clients []*regexp.Regexp
+}
+
+type bannerData struct {
+	Hostname string
+	IP       string
+}
+
+var personaBanners = map[string]personaBanner{
+	// the corporate server only bothers people using an interactive client
+	CentOS: {
+		text: template.Must(template.New(CentOS).Parse(
+			"#####################################################################\n" +
+				"#                   Authorized access only!                         #\n" +
+				"#  {{printf \"%-63s\" (printf \"%s (%s)\" .Hostname .IP)}}  #\n" +
+				"#  Disconnect IMMEDIATELY if you are not an authorized user!        #\n" +
+				"#  All actions are monitored and recorded.                          #\n" +
+				"#####################################################################\n")),
+		clients: []*regexp.Regexp{
+			regexp.MustCompile(`^SSH-2\.0-OpenSSH`),
+			regexp.MustCompile(`^SSH-2\.0-PuTTY`),
+			regexp.MustCompile(`^SSH-2\.0-WinSCP`),
+		},
+	},
+}
+
+// personaKeyboardInteractive is the instruction shown with the keyboard-interactive
+// password prompt, appliances tend to put their MOTD there.
+var personaKeyboardInteractive = map[string]*template.Template{
+	RaspberryPi: template.Must(template.New(RaspberryPi).Parse("Raspberry Pi {{.Hostname}}\n")),
+}
+
+// renderBanner returns the pre-authentication banner of kernelInfo for the
+// client of conn, or "" when it has none for that client.
+func renderBanner(kernelInfo string, conn ssh.ConnMetadata) string {
+	banner, ok := personaBanners[kernelInfo]
+	if !ok {
+		return ""
+	}
+
+	if len(banner.clients) > 0 {
+		matched := false
+		for _, client := range banner.clients {
+			if client.Match(conn.ClientVersion()) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return ""
+		}
+	}
+
+	return renderPersonaTemplate(banner.text, kernelInfo, conn)
+}
+
+func renderPersonaTemplate(t *template.Template, kernelInfo string, conn ssh.ConnMetadata) string {
+	if t == nil {
+		return ""
+	}
+
+	ip, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		ip = conn.LocalAddr().String()
+	}
+
+	var b bytes.Buffer
+	err = t.Execute(&b, bannerData{
+		Hostname: hostnames[kernelInfo],
+		IP:       ip,
+	})
+	if err != nil {
+		log.Print("failed to render banner:", err.Error()+"\n")
+		return ""
+	}
+	return b.String()
+}
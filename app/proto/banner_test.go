@@ -0,0 +1,97 @@
+package proto
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// testConnMeta is the ssh.ConnMetadata of a client connected to 192.0.2.10.
+type testConnMeta struct {
+	clientVersion string
+}
+
+func (m testConnMeta) User() string          { return "root" }
+func (m testConnMeta) SessionID() []byte     { return nil }
+func (m testConnMeta) ClientVersion() []byte { return []byte(m.clientVersion) }
+func (m testConnMeta) ServerVersion() []byte { return []byte(sshProfiles[CentOS].version) }
+func (m testConnMeta) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 50000}
+}
+func (m testConnMeta) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 22}
+}
+
+func TestBannerCallback(t *testing.T) {
+	tests := []struct {
+		persona string
+		client  string
+		banner  string
+	}{
+		{CentOS, "SSH-2.0-OpenSSH_8.9p1 Ubuntu-3", "#  " + hostnames[CentOS] + " (192.0.2.10)"},
+		{CentOS, "SSH-2.0-PuTTY_Release_0.76", "Authorized access only!"},
+		{CentOS, "SSH-2.0-WinSCP_release_5.19", "Authorized access only!"},
+		{CentOS, "SSH-2.0-libssh_0.9.6", ""},
+		{CentOS, "SSH-2.0-Go", ""},
+		{CentOS, "SSH-2.0-paramiko_2.11.0 OpenSSH", ""},
+		{Debian, "SSH-2.0-OpenSSH_8.9p1", ""},
+		{RaspberryPi, "SSH-2.0-PuTTY_Release_0.76", ""},
+	}
+
+	for _, test := range tests {
+		auth := &connAuth{}
+		started := false
+		config := newServerConfig(test.persona, nil, auth, func() { started = true })
+
+		banner := config.BannerCallback(testConnMeta{test.client})
+		if !started {
+			t.Errorf("%s %s: authentication not started", test.persona, test.client)
+		}
+		if (test.banner == "") != (banner == "") || !strings.Contains(banner, test.banner) {
+			t.Errorf("%s %s: banner %q, want it to contain %q", test.persona, test.client, banner, test.banner)
+		}
+		if auth.bannerShown != (banner != "") {
+			t.Errorf("%s %s: bannerShown %t", test.persona, test.client, auth.bannerShown)
+		}
+		// sshd pads the host line to the frame
+		for _, line := range strings.Split(strings.TrimSuffix(banner, "\n"), "\n") {
+			if banner != "" && len(line) != 69 {
+				t.Errorf("%s %s: line %q is %d wide", test.persona, test.client, line, len(line))
+			}
+		}
+	}
+}
+
+func TestKeyboardInteractiveInstruction(t *testing.T) {
+	tests := []struct {
+		persona     string
+		instruction string
+	}{
+		{RaspberryPi, "Raspberry Pi " + hostnames[RaspberryPi] + "\n"},
+		{Debian, ""},
+		{CentOS, ""},
+	}
+
+	for _, test := range tests {
+		auth := &connAuth{}
+		config := newServerConfig(test.persona, nil, auth, func() {})
+
+		instruction := ""
+		_, err := config.KeyboardInteractiveCallback(testConnMeta{"SSH-2.0-OpenSSH_8.9p1"}, func(user, inst string, questions []string, echos []bool) ([]string, error) {
+			instruction = inst
+			if len(questions) != 1 || questions[0] != "Password: " || echos[0] {
+				t.Errorf("%s: asked %q %v", test.persona, questions, echos)
+			}
+			return []string{"hunter2"}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instruction != test.instruction {
+			t.Errorf("%s: instruction %q, want %q", test.persona, instruction, test.instruction)
+		}
+		if auth.password != "hunter2" || auth.method != "keyboard-interactive" {
+			t.Errorf("%s: captured %q with %q", test.persona, auth.password, auth.method)
+		}
+	}
+}
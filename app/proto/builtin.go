@@ -0,0 +1,121 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// exitInfo is the outcome of an emulated command. exited is set when the
+// command terminated the shell itself (exit, logout, kill $$), and signal
+// when it was killed instead of exiting normally.
+type exitInfo struct {
+	status int
+	signal string
+	exited bool
+}
+
+var signalNumbers = map[string]string{
+	"1":  "HUP",
+	"2":  "INT",
+	"3":  "QUIT",
+	"6":  "ABRT",
+	"9":  "KILL",
+	"15": "TERM",
+}
+
+// signals an interactive bash ignores when they are sent to itself.
+var interactiveIgnoredSignals = map[string]bool{
+	"INT":  true,
+	"QUIT": true,
+	"TERM": true,
+}
+
+func logCommand(line string, logFile *os.File, commandList *os.File) {
+	fmt.Fprint(logFile, "$ "+line+"\n")
+	fmt.Fprint(commandList, "$ "+line+"\n")
+}
+
+// emulateBuiltin handles the builtins that can end the shell: exit, logout
+// and kill aimed at the shell's own pid. ok is false when line is none of them.
+func emulateBuiltin(line string, lastStatus int, interactive bool, stderr io.Writer, logFile *os.File, commandList *os.File) (info exitInfo, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return exitInfo{}, false
+	}
+
+	switch fields[0] {
+	case "logout":
+		logCommand(line, logFile, commandList)
+		if !interactive {
+			fmt.Fprint(stderr, "bash: logout: not login shell: use `exit'\n")
+			return exitInfo{status: 1}, true
+		}
+		return exitInfo{status: exitArgument(fields[1:], lastStatus, stderr), exited: true}, true
+	case "exit":
+		logCommand(line, logFile, commandList)
+		return exitInfo{status: exitArgument(fields[1:], lastStatus, stderr), exited: true}, true
+	case "kill":
+		signal := "TERM"
+		args := fields[1:]
+		if len(args) > 1 && args[0] == "-s" {
+			signal = parseSignal(args[1])
+			args = args[2:]
+		} else if len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			signal = parseSignal(args[0][1:])
+			args = args[1:]
+		}
+		if len(args) != 1 || args[0] != "$$" || signal == "" {
+			return exitInfo{}, false
+		}
+
+		logCommand(line, logFile, commandList)
+		if interactive && interactiveIgnoredSignals[signal] {
+			return exitInfo{}, true
+		}
+		return exitInfo{status: 128 + signalNumber(signal), signal: signal, exited: true}, true
+	}
+
+	return exitInfo{}, false
+}
+
+// exitArgument returns the status requested by "exit [n]", bash style.
+func exitArgument(args []string, lastStatus int, stderr io.Writer) int {
+	if len(args) == 0 {
+		return lastStatus
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprint(stderr, "bash: exit: "+args[0]+": numeric argument required\n")
+		return 2
+	}
+	return n & 0xff
+}
+
+// parseSignal accepts "9", "KILL" or "SIGKILL" and returns "KILL".
+func parseSignal(s string) string {
+	if name, ok := signalNumbers[s]; ok {
+		return name
+	}
+
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	for _, v := range signalNumbers {
+		if v == name {
+			return name
+		}
+	}
+	return ""
+}
+
+func signalNumber(signal string) int {
+	for k, v := range signalNumbers {
+		if v == signal {
+			n, _ := strconv.Atoi(k)
+			return n
+		}
+	}
+	return 0
+}
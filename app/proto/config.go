@@ -0,0 +1,126 @@
+package proto
+
+import (
+	"time"
+)
+
+// Config holds the server settings that can be changed from the command line.
+type Config struct {
+	// SSHAddrs and TelnetAddrs are the addresses the listeners bind.
+	SSHAddrs    AddrList
+	TelnetAddrs AddrList
+
+	// HandshakeTimeout bounds the protocol negotiation before authentication,
+	// AuthTimeout the login itself (LoginGraceTime of sshd).
+	HandshakeTimeout time.Duration
+	AuthTimeout      time.Duration
+	// IdleTimeout closes sessions where the client has sent nothing for that
+	// long, SessionTimeout closes any connection that has lasted that long.
+	IdleTimeout    time.Duration
+	SessionTimeout time.Duration
+
+	// HostKeyDir holds one directory of ssh host keys per persona.
+	HostKeyDir string
+
+	// AcceptTCPIPForward makes "ssh -R" look like it works: tcpip-forward
+	// requests are granted (with a made up port when 0 is asked for) instead of refused.
+	AcceptTCPIPForward bool
+
+	// ForwardPolicy decides per destination port what happens to direct-tcpip channels.
+	ForwardPolicy ForwardPolicy
+	// ForwardCaptureBytes is how much of the traffic sent into a tunnel is kept.
+	ForwardCaptureBytes int
+
+	// MaxConns and MaxConnsPerIP cap the open connections of both listeners,
+	// in total and per source address. ConnRate is how many new connections
+	// per second an address may open once its ConnBurst is spent. Zero
+	// disables a limit.
+	MaxConns      int
+	MaxConnsPerIP int
+	ConnRate      float64
+	ConnBurst     int
+	// LimitAction is what happens to connections over a limit, MaxTarpits
+	// how many of them can be held at once before the rest are dropped.
+	LimitAction LimitAction
+	MaxTarpits  int
+
+	// Connections go to the tarpit when they come from TarpitCIDRs, when an
+	// ssh client version matches one of TarpitClients, or when their address
+	// has opened more than TarpitAfter of them on either listener (0 for never). The tarpit
+	// sends something every TarpitDelay and lets go after TarpitTimeout.
+	TarpitCIDRs   CIDRList
+	TarpitClients PatternList
+	TarpitAfter   int
+	TarpitDelay   time.Duration
+	TarpitTimeout time.Duration
+
+	// ProxyBackends are the real ssh servers sessions are relayed to once
+	// authenticated, one session per backend at a time. Sessions are
+	// emulated when there are none, or none free.
+	ProxyBackends BackendList
+
+	// ProxyProtocol tells whether connections start with a PROXY protocol
+	// header giving the real client address. When ProxyProtocolFrom is set,
+	// only headers coming from these networks are believed.
+	ProxyProtocol     ProxyProtocolMode
+	ProxyProtocolFrom CIDRList
+
+	// TelnetMaxTries is how many user name and password pairs a telnet
+	// client may try before being disconnected (0 for no limit), the login
+	// succeeding on try TelnetAcceptAfter (0 for never). Each failure is
+	// answered after TelnetFailDelay. TelnetLoginPrompt and
+	// TelnetPasswordPrompt replace the prompts of all the personas, or of
+	// some of them.
+	TelnetMaxTries       int
+	TelnetAcceptAfter    int
+	TelnetFailDelay      time.Duration
+	TelnetLoginPrompt    PromptMap
+	TelnetPasswordPrompt PromptMap
+	// TelnetSignatures is the file of the fingerprints of known telnet
+	// clients, such as the bots of the Mirai family.
+	TelnetSignatures string
+
+	// TelnetTLSAddrs are the addresses of the telnet over TLS listener
+	// (telnets, port 992), off when empty. It serves TelnetTLSCert and
+	// TelnetTLSKey, or certificates made up per persona when they are not set.
+	TelnetTLSAddrs AddrList
+	TelnetTLSCert  string
+	TelnetTLSKey   string
+
+	// StatsAddr is where the counters are served over http, nowhere when empty.
+	StatsAddr string
+}
+
+// DefaultConfig returns the settings used when no flag is given.
+func DefaultConfig() *Config {
+	return &Config{
+		SSHAddrs:           AddrList{":2222"},
+		TelnetAddrs:        AddrList{":5555"},
+		HandshakeTimeout:   15 * time.Second,
+		AuthTimeout:        120 * time.Second,
+		IdleTimeout:        5 * time.Minute,
+		SessionTimeout:     30 * time.Minute,
+		HostKeyDir:         "./hostkeys",
+		AcceptTCPIPForward: false,
+		ForwardPolicy: ForwardPolicy{
+			Default: ForwardEmulate,
+			Ports:   map[uint32]string{},
+		},
+		ForwardCaptureBytes: 64 * 1024,
+		MaxConns:            1024,
+		MaxConnsPerIP:       16,
+		ConnRate:            1,
+		ConnBurst:           10,
+		LimitAction:         LimitDrop,
+		MaxTarpits:          256,
+		TarpitAfter:         0,
+		TarpitDelay:         10 * time.Second,
+		TarpitTimeout:       time.Hour,
+		ProxyProtocol:       ProxyProtocolOff,
+		TelnetMaxTries:      3,
+		TelnetAcceptAfter:   2,
+		TelnetFailDelay:     3 * time.Second,
+		TelnetSignatures:    "./telnet-signatures.txt",
+		StatsAddr:           "",
+	}
+}
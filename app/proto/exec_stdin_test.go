@@ -0,0 +1,82 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStdinConsumer(t *testing.T) {
+	tests := map[string]string{
+		"sh -s":                      "shell",
+		"/bin/bash -s -- arg":        "shell",
+		"bash":                       "shell",
+		"sh -c 'uname'":              "",
+		"bash script.sh":             "",
+		"cat":                        "cat",
+		"cat - > /tmp/.x":            "cat",
+		"cat >>.ssh/authorized_keys": "cat",
+		"cat /etc/passwd":            "",
+		"tee /tmp/a":                 "tee",
+		"uname -a":                   "",
+		"":                           "",
+	}
+	for command, kind := range tests {
+		if got := stdinConsumer(command); got != kind {
+			t.Errorf("stdinConsumer(%q) = %q, want %q", command, got, kind)
+		}
+	}
+}
+
+func TestExecStdin(t *testing.T) {
+	script := "uname\necho hi\n"
+	big := strings.Repeat("k", maxStdinArtifact+10)
+
+	tests := []struct {
+		command string
+		stdin   string
+		kind    string
+		out     string
+		saved   string
+	}{
+		{"sh -s", script, "shell", "Linux\nhi\n", script},
+		{"bash -s", script, "shell", "Linux\nhi\n", script},
+		{"cat", "ssh-rsa AAAA\n", "cat", "ssh-rsa AAAA\n", "ssh-rsa AAAA\n"},
+		{"cat > .ssh/authorized_keys", "ssh-rsa AAAA\n", "cat", "", "ssh-rsa AAAA\n"},
+		{"tee -a .ssh/authorized_keys", "ssh-rsa AAAA\n", "tee", "ssh-rsa AAAA\n", "ssh-rsa AAAA\n"},
+		{"cat > /tmp/.payload", big, "cat", "", big[:maxStdinArtifact]},
+	}
+
+	for _, test := range tests {
+		logFile := testLogFile(t)
+		client, served := startTestServer(t, DefaultConfig(), logFile)
+
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.Stdin = strings.NewReader(test.stdin)
+		out, err := session.Output(test.command)
+		if err != nil {
+			t.Errorf("%s: %v", test.command, err)
+		}
+		if string(out) != test.out {
+			t.Errorf("%s: output %q, want %q", test.command, out, test.out)
+		}
+
+		client.Close()
+		<-served
+
+		logData := readLog(t, logFile)
+		if !strings.Contains(logData, "Stdin:"+test.kind+"\n") {
+			t.Errorf("%s: stdin kind not logged:\n%s", test.command, logData)
+		}
+		if saved := readArtifact(t, logData, "stdin"); saved != test.saved {
+			t.Errorf("%s: saved %d bytes, want %d", test.command, len(saved), len(test.saved))
+		}
+		truncated := strings.Contains(logData, fmt.Sprintf("StdinTruncated:%d\n", maxStdinArtifact))
+		if truncated != (len(test.stdin) > maxStdinArtifact) {
+			t.Errorf("%s: truncation logged %t", test.command, truncated)
+		}
+	}
+}
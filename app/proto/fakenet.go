@@ -0,0 +1,621 @@
+package proto
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Fake services answering the direct-tcpip channels whose policy is "emulate",
+// so that an attacker using the honeypot as a proxy gets plausible replies.
+
+var fakeServicePorts = map[uint32]string{
+	80:   "http",
+	8000: "http",
+	8080: "http",
+	8888: "http",
+	443:  "https",
+	8443: "https",
+	25:   "smtp",
+	587:  "smtp",
+	2525: "smtp",
+	465:  "smtps",
+}
+
+// banners of the services that talk first, the rest of the ports stay silent.
+var fakeBanners = map[uint32]string{
+	21:  "220 (vsFTPd 3.0.3)\r\n",
+	22:  "SSH-2.0-OpenSSH_7.6p1 Ubuntu-4ubuntu0.3\r\n",
+	110: "+OK Dovecot (Ubuntu) ready.\r\n",
+	143: "* OK [CAPABILITY IMAP4rev1 SASL-IR LOGIN-REFERRALS ID ENABLE IDLE LITERAL+ STARTTLS AUTH=PLAIN] Dovecot (Ubuntu) ready.\r\n",
+}
+
+const fakeServerHeader = "nginx/1.18.0 (Ubuntu)"
+
+const fakeIndexPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>Welcome to nginx!</title>
+<style>
+    body {
+        width: 35em;
+        margin: 0 auto;
+        font-family: Tahoma, Verdana, Arial, sans-serif;
+    }
+</style>
+</head>
+<body>
+<h1>Welcome to nginx!</h1>
+<p>If you see this page, the nginx web server is successfully installed and
+working. Further configuration is required.</p>
+
+<p>For online documentation and support please refer to
+<a href="http://nginx.org/">nginx.org</a>.<br/>
+Commercial support is available at
+<a href="http://nginx.com/">nginx.com</a>.</p>
+
+<p><em>Thank you for using nginx.</em></p>
+</body>
+</html>
+`
+
+const fakeErrorPage = `<html>
+<head><title>%[1]d %[2]s</title></head>
+<body>
+<center><h1>%[1]d %[2]s</h1></center>
+<hr><center>nginx/1.18.0 (Ubuntu)</center>
+</body>
+</html>
+`
+
+// maxSmtpMessage is the SIZE announced in EHLO, longer messages are cut.
+const maxSmtpMessage = 10240000
+
+// maxSmtpLine is the longest command or DATA line read, past it the
+// client is told off and dropped.
+const maxSmtpLine = 4096
+
+// maxHTTPHeaderBytes bounds the request line and headers of a request.
+const maxHTTPHeaderBytes = 64 * 1024
+
+var errLineTooLong = errors.New("line too long")
+
+// serveFakeService answers a direct-tcpip channel with the fake service
+// listening on its destination port, recording the whole conversation.
+func serveFakeService(sshChannel ssh.Channel, dest directTcpipMsg, conf *Config, logFile *os.File) error {
+	conversation, err := newConversation(logFile, fmt.Sprintf("conversation-%d", dest.DestPort), conf.ForwardCaptureBytes)
+	if err != nil {
+		return err
+	}
+	defer conversation.Close()
+
+	conn := &channelConn{
+		Channel: sshChannel,
+		local:   tunnelAddr(net.JoinHostPort(dest.DestAddr, fmt.Sprint(dest.DestPort))),
+		remote:  tunnelAddr(net.JoinHostPort(dest.OrigAddr, fmt.Sprint(dest.OrigPort))),
+	}
+
+	service := fakeServicePorts[dest.DestPort]
+	fmt.Fprint(logFile, "FakeService:"+service+"\n")
+
+	switch service {
+	case "http":
+		return serveFakeHTTP(conversation.wrap(conn), logFile)
+	case "https":
+		tlsConn, err := fakeTLSHandshake(conn, logFile)
+		if err != nil {
+			return err
+		}
+		return serveFakeHTTP(conversation.wrap(tlsConn), logFile)
+	case "smtp":
+		return serveFakeSMTP(conn, conversation, dest.DestAddr, logFile, false)
+	case "smtps":
+		tlsConn, err := fakeTLSHandshake(conn, logFile)
+		if err != nil {
+			return err
+		}
+		return serveFakeSMTP(tlsConn, conversation, dest.DestAddr, logFile, true)
+	default:
+		return serveFakeBanner(conversation.wrap(conn), fakeBanners[dest.DestPort])
+	}
+}
+
+// conversation records both directions of a fake service session into one
+// artifact, up to max bytes of data; wrap can be called again when the
+// stream is upgraded to TLS.
+type conversation struct {
+	mu        sync.Mutex
+	file      *os.File
+	logFile   *os.File
+	kind      string
+	max       int
+	left      int
+	truncated bool
+}
+
+func newConversation(logFile *os.File, kind string, max int) (*conversation, error) {
+	f, err := createArtifact(logFile, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conversation{
+		file:    f,
+		logFile: logFile,
+		kind:    kind,
+		max:     max,
+		left:    max,
+	}, nil
+}
+
+func (c *conversation) record(direction string, p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(p) > c.left {
+		p = p[:c.left]
+		if !c.truncated {
+			c.truncated = true
+			fmt.Fprintf(c.logFile, "ConversationTruncated:%s %d\n", c.kind, c.max)
+		}
+	}
+	if len(p) == 0 {
+		return
+	}
+	c.left -= len(p)
+
+	fmt.Fprintf(c.file, "%s %s %d\n", direction, time.Now().UTC().Format(time.RFC3339Nano), len(p))
+	c.file.Write(p)
+	c.file.Write([]byte("\n"))
+}
+
+func (c *conversation) wrap(rw io.ReadWriter) io.ReadWriter {
+	return &recordedStream{
+		wrapped:      rw,
+		conversation: c,
+	}
+}
+
+func (c *conversation) Close() error {
+	return c.file.Close()
+}
+
+type recordedStream struct {
+	wrapped      io.ReadWriter
+	conversation *conversation
+}
+
+func (s *recordedStream) Read(p []byte) (int, error) {
+	n, err := s.wrapped.Read(p)
+	if n > 0 {
+		s.conversation.record("-->", p[:n])
+	}
+	return n, err
+}
+
+func (s *recordedStream) Write(p []byte) (int, error) {
+	s.conversation.record("<--", p)
+	return s.wrapped.Write(p)
+}
+
+// channelConn lets an ssh.Channel stand in for the net.Conn crypto/tls wants.
+type channelConn struct {
+	ssh.Channel
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr                { return c.local }
+func (c *channelConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *channelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *channelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *channelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tcp" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// fakeCertificates caches one self-signed certificate per requested server
+// name, bounded because the names come from the client.
+var fakeCertificates = struct {
+	sync.Mutex
+	byName map[string]*tls.Certificate
+}{
+	byName: map[string]*tls.Certificate{},
+}
+
+const maxFakeCertificates = 256
+
+func fakeCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" {
+		name = "localhost"
+	}
+
+	fakeCertificates.Lock()
+	defer fakeCertificates.Unlock()
+
+	if cert, ok := fakeCertificates.byName[name]; ok {
+		return cert, nil
+	}
+	if len(fakeCertificates.byName) >= maxFakeCertificates {
+		name = "localhost"
+		if cert, ok := fakeCertificates.byName[name]; ok {
+			return cert, nil
+		}
+	}
+
+	cert, err := selfSignedCertificate(name)
+	if err != nil {
+		return nil, err
+	}
+	fakeCertificates.byName[name] = &cert
+	return &cert, nil
+}
+
+func fakeTLSHandshake(conn net.Conn, logFile *os.File) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: fakeCertificate,
+	})
+
+	err := tlsConn.Handshake()
+	if err != nil {
+		fmt.Fprint(logFile, "TlsHandshakeFailed:"+err.Error()+"\n")
+		return nil, err
+	}
+
+	state := tlsConn.ConnectionState()
+	fmt.Fprintf(logFile, "TlsHandshake:version=%#04x cipher=%#04x sni=%q\n", state.Version, state.CipherSuite, state.ServerName)
+	return tlsConn, nil
+}
+
+func serveFakeBanner(rw io.ReadWriter, banner string) error {
+	if banner != "" {
+		_, err := io.WriteString(rw, banner)
+		if err != nil {
+			return err
+		}
+	}
+
+	// nothing is answered past the banner, but the client is still recorded
+	_, err := io.Copy(ioutil.Discard, rw)
+	return err
+}
+
+func serveFakeHTTP(rw io.ReadWriter, logFile *os.File) error {
+	// as net/http does, the limit covers the headers and is lifted for the body
+	limited := &io.LimitedReader{R: rw}
+	reader := bufio.NewReader(limited)
+
+	for {
+		limited.N = maxHTTPHeaderBytes
+		req, err := http.ReadRequest(reader)
+		if limited.N == 0 {
+			fmt.Fprint(logFile, "HttpBadRequest:headers too large\n")
+			resp := fakeHTTPResponse(nil, http.StatusRequestHeaderFieldsTooLarge)
+			return resp.Write(rw)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprint(logFile, "HttpBadRequest:"+err.Error()+"\n")
+			resp := fakeHTTPResponse(nil, http.StatusBadRequest)
+			return resp.Write(rw)
+		}
+
+		fmt.Fprintf(logFile, "HttpRequest:%s %s %s host=%q user-agent=%q\n", req.Method, req.RequestURI, req.Proto, req.Host, req.UserAgent())
+		limited.N = math.MaxInt64
+
+		_, err = io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		status := http.StatusNotFound
+		switch {
+		case req.Method == "CONNECT":
+			status = http.StatusBadRequest
+		case req.URL.Path == "/" || req.URL.Path == "/index.html":
+			status = http.StatusOK
+		}
+
+		resp := fakeHTTPResponse(req, status)
+		err = resp.Write(rw)
+		if err != nil {
+			return err
+		}
+		if resp.Close {
+			return nil
+		}
+	}
+}
+
+func fakeHTTPResponse(req *http.Request, status int) *http.Response {
+	body := fakeIndexPage
+	if status != http.StatusOK {
+		body = fmt.Sprintf(fakeErrorPage, status, http.StatusText(status))
+	}
+
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         req == nil || req.Close || status == http.StatusBadRequest || status == http.StatusRequestHeaderFieldsTooLarge,
+	}
+	resp.Header.Set("Server", fakeServerHeader)
+	resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	resp.Header.Set("Content-Type", "text/html")
+	if status == http.StatusOK {
+		resp.Header.Set("Last-Modified", "Tue, 21 Apr 2020 14:09:01 GMT")
+		resp.Header.Set("Accept-Ranges", "bytes")
+	}
+
+	return resp
+}
+
+// serveFakeSMTP is a Postfix lookalike that accepts every message and keeps
+// it as an artifact instead of relaying it.
+func serveFakeSMTP(conn net.Conn, conversation *conversation, hostname string, logFile *os.File, secure bool) error {
+	rw := conversation.wrap(conn)
+	reader := bufio.NewReaderSize(rw, maxSmtpLine)
+
+	reply := func(lines ...string) error {
+		_, err := io.WriteString(rw, strings.Join(lines, "\r\n")+"\r\n")
+		return err
+	}
+	readLine := func() (string, error) {
+		line, isPrefix, err := reader.ReadLine()
+		if isPrefix {
+			fmt.Fprintf(logFile, "SmtpLineTooLong:%d\n", maxSmtpLine)
+			reply("500 5.5.0 Error: line too long")
+			return "", errLineTooLong
+		}
+		return string(line), err
+	}
+
+	err := reply("220 " + hostname + " ESMTP Postfix (Ubuntu)")
+	if err != nil {
+		return err
+	}
+
+	helo := ""
+	from := ""
+	to := []string{}
+
+	for {
+		line, err := readLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		verb := strings.ToUpper(parts[0])
+		arg := ""
+		if len(parts) == 2 {
+			arg = strings.TrimSpace(parts[1])
+		}
+
+		switch verb {
+		case "HELO":
+			helo = arg
+			err = reply("250 " + hostname)
+		case "EHLO":
+			helo = arg
+			extensions := []string{"250-" + hostname, "250-PIPELINING", fmt.Sprintf("250-SIZE %d", maxSmtpMessage)}
+			if !secure {
+				extensions = append(extensions, "250-STARTTLS")
+			}
+			extensions = append(extensions, "250-AUTH PLAIN LOGIN", "250-ENHANCEDSTATUSCODES", "250-8BITMIME", "250 DSN")
+			err = reply(extensions...)
+		case "STARTTLS":
+			if secure {
+				err = reply("554 5.5.1 Error: TLS already active")
+				break
+			}
+			err = reply("220 2.0.0 Ready to start TLS")
+			if err != nil {
+				return err
+			}
+
+			var tlsConn *tls.Conn
+			tlsConn, err = fakeTLSHandshake(conn, logFile)
+			if err != nil {
+				return err
+			}
+			// RFC 3207: everything learned before the upgrade is forgotten
+			conn = tlsConn
+			rw = conversation.wrap(tlsConn)
+			reader = bufio.NewReaderSize(rw, maxSmtpLine)
+			secure = true
+			helo, from, to = "", "", []string{}
+		case "AUTH":
+			mechanism := strings.ToUpper(strings.SplitN(arg, " ", 2)[0])
+			if mechanism != "PLAIN" && mechanism != "LOGIN" {
+				err = reply("535 5.7.8 Error: authentication failed: Invalid authentication mechanism")
+				break
+			}
+
+			var user, password string
+			user, password, err = fakeSMTPAuth(arg, reply, readLine)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(logFile, "SmtpAuth:%q:%q\n", user, password)
+			err = reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			if helo == "" {
+				err = reply("503 5.5.1 Error: send HELO/EHLO first")
+				break
+			}
+			from = arg
+			to = []string{}
+			err = reply("250 2.1.0 Ok")
+		case "RCPT":
+			if from == "" {
+				err = reply("503 5.5.1 Error: need MAIL command")
+				break
+			}
+			to = append(to, arg)
+			err = reply("250 2.1.5 Ok")
+		case "DATA":
+			if len(to) == 0 {
+				err = reply("503 5.5.1 Error: need RCPT command")
+				break
+			}
+			err = reply("354 End data with <CR><LF>.<CR><LF>")
+			if err != nil {
+				return err
+			}
+
+			var size int
+			size, err = saveSMTPData(readLine, logFile)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(logFile, "SmtpMessage:helo=%q %s %s size=%d\n", helo, from, strings.Join(to, " "), size)
+
+			from, to = "", []string{}
+			err = reply(fmt.Sprintf("250 2.0.0 Ok: queued as %X", rand.Int63()&0xfffffffff))
+		case "RSET":
+			from, to = "", []string{}
+			err = reply("250 2.0.0 Ok")
+		case "NOOP":
+			err = reply("250 2.0.0 Ok")
+		case "VRFY":
+			err = reply("252 2.0.0 " + arg)
+		case "QUIT":
+			return reply("221 2.0.0 Bye")
+		default:
+			err = reply("502 5.5.2 Error: command not recognized")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fakeSMTPAuth runs the AUTH PLAIN or AUTH LOGIN exchange and returns the
+// decoded credentials, which are always accepted.
+func fakeSMTPAuth(arg string, reply func(...string) error, readLine func() (string, error)) (string, string, error) {
+	fields := strings.Fields(arg)
+
+	decode := func(s string) string {
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return s
+		}
+		return string(b)
+	}
+
+	if strings.ToUpper(fields[0]) == "PLAIN" {
+		response := ""
+		if len(fields) > 1 {
+			response = fields[1]
+		} else {
+			err := reply("334 ")
+			if err != nil {
+				return "", "", err
+			}
+			response, err = readLine()
+			if err != nil {
+				return "", "", err
+			}
+		}
+		// authzid \0 authcid \0 password
+		parts := strings.SplitN(decode(response), "\x00", 3)
+		if len(parts) == 3 {
+			return parts[1], parts[2], nil
+		}
+		return decode(response), "", nil
+	}
+
+	user := ""
+	if len(fields) > 1 {
+		user = decode(fields[1])
+	} else {
+		err := reply("334 VXNlcm5hbWU6")
+		if err != nil {
+			return "", "", err
+		}
+		line, err := readLine()
+		if err != nil {
+			return "", "", err
+		}
+		user = decode(line)
+	}
+
+	err := reply("334 UGFzc3dvcmQ6")
+	if err != nil {
+		return "", "", err
+	}
+	line, err := readLine()
+	if err != nil {
+		return "", "", err
+	}
+	return user, decode(line), nil
+}
+
+// saveSMTPData streams a DATA section into an artifact, of which it keeps
+// maxSmtpMessage bytes, and returns the size of the whole message.
+func saveSMTPData(readLine func() (string, error), logFile *os.File) (int, error) {
+	var w io.Writer = ioutil.Discard
+	artifact, err := createArtifact(logFile, "smtp-message")
+	if err != nil {
+		log.Print("failed to save artifact:", err.Error()+"\n")
+	} else {
+		defer artifact.Close()
+		w = artifact
+	}
+
+	message := newLimitedWriter(w, maxSmtpMessage)
+	size, err := readSMTPData(readLine, message)
+	if message.truncated {
+		fmt.Fprintf(logFile, "SmtpMessageTruncated:%d\n", maxSmtpMessage)
+	}
+	return size, err
+}
+
+// readSMTPData copies a DATA section up to the lone dot to w, undoing dot
+// stuffing, and returns how many bytes it was.
+func readSMTPData(readLine func() (string, error), w io.Writer) (int, error) {
+	size := 0
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			return size, err
+		}
+		if line == "." {
+			return size, nil
+		}
+
+		line = strings.TrimPrefix(line, ".") + "\r\n"
+		size += len(line)
+		w.Write([]byte(line))
+	}
+}
@@ -0,0 +1,302 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConversationBounded(t *testing.T) {
+	logFile := testLogFile(t)
+
+	c, err := newConversation(logFile, "conversation-80", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.record("-->", []byte("0123456"))
+	c.record("<--", []byte("789abc"))
+	c.record("-->", []byte("def"))
+	c.Close()
+
+	data, err := ioutil.ReadFile(c.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "\n0123456\n") || !strings.Contains(string(data), " 3\n789\n") || strings.Contains(string(data), "def") {
+		t.Errorf("conversation not cut at 10 bytes:\n%s", data)
+	}
+
+	logData := readLog(t, logFile)
+	if strings.Count(logData, "ConversationTruncated:conversation-80 10\n") != 1 {
+		t.Errorf("truncation not logged once:\n%s", logData)
+	}
+}
+
+func TestFakeSMTPLineTooLong(t *testing.T) {
+	logFile := testLogFile(t)
+
+	c, err := newConversation(logFile, "conversation-25", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- serveFakeSMTP(server, c, "mail.example.com", logFile, false)
+		server.Close()
+	}()
+
+	br := bufio.NewReader(client)
+	if line, _ := br.ReadString('\n'); !strings.HasPrefix(line, "220 ") {
+		t.Fatalf("greeting %q", line)
+	}
+	go io.WriteString(client, "HELO "+strings.Repeat("x", 2*maxSmtpLine)+"\r\n")
+	if line, _ := br.ReadString('\n'); !strings.HasPrefix(line, "500 ") {
+		t.Errorf("reply to a long line %q", line)
+	}
+	if err := <-done; err != errLineTooLong {
+		t.Errorf("serveFakeSMTP returned %v", err)
+	}
+}
+
+func TestFakeHTTPHeadersTooLarge(t *testing.T) {
+	logFile := testLogFile(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		serveFakeHTTP(server, logFile)
+		server.Close()
+	}()
+
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: x\r\nX-Junk: "+strings.Repeat("x", 2*maxHTTPHeaderBytes)+"\r\n\r\n")
+	line, _ := bufio.NewReader(client).ReadString('\n')
+	if line != "HTTP/1.1 431 Request Header Fields Too Large\r\n" {
+		t.Errorf("status line %q", line)
+	}
+}
+
+func TestFakeHTTP(t *testing.T) {
+	logFile := testLogFile(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- serveFakeHTTP(server, logFile)
+		server.Close()
+	}()
+
+	br := bufio.NewReader(client)
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "Welcome to nginx!"},
+		{"/index.html", http.StatusOK, "Welcome to nginx!"},
+		{"/wp-login.php", http.StatusNotFound, "<title>404 Not Found</title>"},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "http://example.com"+test.path, nil)
+		req.Header.Set("User-Agent", "zgrab/0.x")
+		req.Close = i == len(tests)-1
+		go req.Write(client)
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || !strings.Contains(string(body), test.body) {
+			t.Errorf("%s: %d %q", test.path, resp.StatusCode, body)
+		}
+		if resp.Header.Get("Server") != fakeServerHeader {
+			t.Errorf("%s: Server %q", test.path, resp.Header.Get("Server"))
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("serveFakeHTTP returned %v", err)
+	}
+
+	logData := readLog(t, logFile)
+	if !strings.Contains(logData, `HttpRequest:GET /wp-login.php HTTP/1.1 host="example.com" user-agent="zgrab/0.x"`+"\n") {
+		t.Errorf("request not logged:\n%s", logData)
+	}
+}
+
+// startFakeSMTP runs the fake SMTP server on a pipe and returns the client end.
+func startFakeSMTP(t *testing.T, logFile *os.File) (net.Conn, <-chan error) {
+	c, err := newConversation(logFile, "conversation-25", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- serveFakeSMTP(server, c, "mail.example.com", logFile, false)
+		server.Close()
+	}()
+	return client, done
+}
+
+// smtpCmd sends a command and checks the code of its reply, which is returned.
+func smtpCmd(t *testing.T, c *textproto.Conn, code int, format string, args ...interface{}) string {
+	if _, err := c.Cmd(format, args...); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%s: %v", fmt.Sprintf(format, args...), err)
+	}
+	return msg
+}
+
+func TestFakeSMTP(t *testing.T) {
+	logFile := testLogFile(t)
+	conn, done := startFakeSMTP(t, logFile)
+	c := textproto.NewConn(conn)
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	smtpCmd(t, c, 503, "MAIL FROM:<a@example.org>")
+	if ehlo := smtpCmd(t, c, 250, "EHLO client.example.org"); !strings.Contains(ehlo, "STARTTLS") {
+		t.Errorf("EHLO without STARTTLS: %q", ehlo)
+	}
+	smtpCmd(t, c, 503, "DATA")
+	smtpCmd(t, c, 250, "MAIL FROM:<a@example.org>")
+	smtpCmd(t, c, 250, "RCPT TO:<b@example.com>")
+	smtpCmd(t, c, 250, "RCPT TO:<c@example.com>")
+	smtpCmd(t, c, 354, "DATA")
+	w := c.DotWriter()
+	io.WriteString(w, "Subject: hi\r\n\r\n.hidden\r\nbye\r\n")
+	w.Close()
+	if _, _, err := c.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+	smtpCmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Errorf("serveFakeSMTP returned %v", err)
+	}
+
+	message := "Subject: hi\r\n\r\n.hidden\r\nbye\r\n"
+	logData := readLog(t, logFile)
+	want := fmt.Sprintf(`SmtpMessage:helo="client.example.org" FROM:<a@example.org> TO:<b@example.com> TO:<c@example.com> size=%d`, len(message))
+	if !strings.Contains(logData, want+"\n") {
+		t.Errorf("%q not in log:\n%s", want, logData)
+	}
+	if data := readArtifact(t, logData, "smtp-message"); data != message {
+		t.Errorf("message %q, want %q", data, message)
+	}
+}
+
+func TestFakeSMTPStartTLS(t *testing.T) {
+	logFile := testLogFile(t)
+	conn, done := startFakeSMTP(t, logFile)
+	c := textproto.NewConn(conn)
+
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	smtpCmd(t, c, 250, "EHLO client.example.org")
+	smtpCmd(t, c, 220, "STARTTLS")
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: "mail.example.com", InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c = textproto.NewConn(tlsConn)
+
+	// the session starts over on the upgraded stream
+	smtpCmd(t, c, 503, "MAIL FROM:<a@example.org>")
+	if ehlo := smtpCmd(t, c, 250, "EHLO client.example.org"); strings.Contains(ehlo, "STARTTLS") {
+		t.Errorf("STARTTLS offered again: %q", ehlo)
+	}
+	smtpCmd(t, c, 554, "STARTTLS")
+	smtpCmd(t, c, 235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret")))
+	smtpCmd(t, c, 221, "QUIT")
+	if err := <-done; err != nil {
+		t.Errorf("serveFakeSMTP returned %v", err)
+	}
+
+	logData := readLog(t, logFile)
+	for _, want := range []string{`sni="mail.example.com"`, `SmtpAuth:"user":"secret"`} {
+		if !strings.Contains(logData, want) {
+			t.Errorf("%q not in log:\n%s", want, logData)
+		}
+	}
+}
+
+func TestFakeBanner(t *testing.T) {
+	for _, port := range []uint32{21, 22, 110, 143, 3306} {
+		logFile := testLogFile(t)
+		c, err := newConversation(logFile, fmt.Sprintf("conversation-%d", port), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, server := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- serveFakeBanner(c.wrap(server), fakeBanners[port])
+			server.Close()
+		}()
+
+		if banner := fakeBanners[port]; banner != "" {
+			line, _ := bufio.NewReader(client).ReadString('\n')
+			if line != banner {
+				t.Errorf("port %d greeted with %q, want %q", port, line, banner)
+			}
+		}
+		io.WriteString(client, "QUIT\r\n")
+		client.Close()
+		if err := <-done; err != nil {
+			t.Errorf("port %d: %v", port, err)
+		}
+		c.Close()
+
+		// what the client sent is recorded past the banner
+		data, err := ioutil.ReadFile(c.file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "\nQUIT\r\n") {
+			t.Errorf("port %d conversation:\n%s", port, data)
+		}
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := newLimitedWriter(&buf, 5)
+	for _, p := range []string{"abc", "def", "gh"} {
+		if n, err := w.Write([]byte(p)); n != len(p) || err != nil {
+			t.Errorf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if buf.String() != "abcde" || !w.truncated {
+		t.Errorf("kept %q, truncated %t", buf.String(), w.truncated)
+	}
+}
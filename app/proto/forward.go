@@ -0,0 +1,133 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// What to do with a direct-tcpip channel ("ssh -L", "ssh -D", ssh used as a proxy).
+const (
+	ForwardReject  = "reject"  // refuse the channel like "AllowTcpForwarding no"
+	ForwardSink    = "sink"    // accept it, record what the client sends and never answer
+	ForwardEmulate = "emulate" // accept it and let a fake service answer
+)
+
+// directTcpipMsg is the extra data of a direct-tcpip channel open (RFC 4254 section 7.2).
+type directTcpipMsg struct {
+	DestAddr string
+	DestPort uint32
+	OrigAddr string
+	OrigPort uint32
+}
+
+// ForwardPolicy picks the forwarding behavior from the destination port.
+// As a flag it reads "default=reject,25=sink,80=emulate".
+type ForwardPolicy struct {
+	Default string
+	Ports   map[uint32]string
+}
+
+func (p *ForwardPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+
+	rules := []string{"default=" + p.Default}
+	ports := []int{}
+	for port := range p.Ports {
+		ports = append(ports, int(port))
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		rules = append(rules, strconv.Itoa(port)+"="+p.Ports[uint32(port)])
+	}
+
+	return strings.Join(rules, ",")
+}
+
+func (p *ForwardPolicy) Set(value string) error {
+	p.Ports = map[uint32]string{}
+
+	for _, rule := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		if len(kv) != 2 {
+			return errors.New("forward policy rule must be port=policy: " + rule)
+		}
+
+		policy := kv[1]
+		if policy != ForwardReject && policy != ForwardSink && policy != ForwardEmulate {
+			return errors.New("unknown forward policy: " + policy)
+		}
+
+		if kv[0] == "default" {
+			p.Default = policy
+			continue
+		}
+
+		port, err := strconv.ParseUint(kv[0], 10, 16)
+		if err != nil {
+			return errors.New("invalid forward policy port: " + kv[0])
+		}
+		p.Ports[uint32(port)] = policy
+	}
+
+	return nil
+}
+
+func (p *ForwardPolicy) lookup(port uint32) string {
+	if policy, ok := p.Ports[port]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+func handleDirectTcpip(sshNewChannel ssh.NewChannel, conf *Config, logFile *os.File) error {
+	var msg directTcpipMsg
+	if err := ssh.Unmarshal(sshNewChannel.ExtraData(), &msg); err != nil {
+		log.Print("malformed direct-tcpip payload:", err.Error()+"\n")
+		return sshNewChannel.Reject(ssh.ConnectionFailed, "open failed")
+	}
+
+	policy := conf.ForwardPolicy.lookup(msg.DestPort)
+
+	fmt.Fprintf(logFile, "DirectTcpip:%s:%d from %s:%d policy=%s\n", msg.DestAddr, msg.DestPort, msg.OrigAddr, msg.OrigPort, policy)
+	log.Printf("direct-tcpip to %s:%d (%s)\n", msg.DestAddr, msg.DestPort, policy)
+
+	if policy == ForwardReject {
+		return sshNewChannel.Reject(ssh.Prohibited, "open failed")
+	}
+
+	sshChannel, sshRequest, err := sshNewChannel.Accept()
+	if err != nil {
+		log.Print("accept direct-tcpip failed:", err.Error()+"\n")
+		return nil
+	}
+	defer sshChannel.Close()
+	go ssh.DiscardRequests(sshRequest)
+
+	if policy == ForwardEmulate {
+		err = serveFakeService(sshChannel, msg, conf, logFile)
+		if err != nil {
+			log.Print("fake service failed:", err.Error()+"\n")
+		}
+		return nil
+	}
+
+	capture := newLimitedBuffer(conf.ForwardCaptureBytes)
+	_, err = io.Copy(capture, sshChannel)
+	if err != nil {
+		log.Print("read direct-tcpip failed:", err.Error()+"\n")
+	}
+
+	// the destination host is client input, so only the port goes into the file name
+	saveArtifact(logFile, fmt.Sprintf("tcpip-%d", msg.DestPort), capture.data)
+	return nil
+}
@@ -0,0 +1,75 @@
+package proto
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDirectTcpipPolicies(t *testing.T) {
+	conf := DefaultConfig()
+	if err := conf.ForwardPolicy.Set("default=reject,25=sink,80=emulate"); err != nil {
+		t.Fatal(err)
+	}
+	conf.ForwardCaptureBytes = 4096
+
+	logFile := testLogFile(t)
+	client, served := startTestServer(t, conf, logFile)
+
+	// reject
+	if _, err := client.Dial("tcp", "192.0.2.1:22"); err == nil {
+		t.Error("rejected channel opened")
+	} else if openErr, ok := err.(*ssh.OpenChannelError); !ok || openErr.Reason != ssh.Prohibited {
+		t.Errorf("rejected with %v", err)
+	}
+
+	// sink, cut at ForwardCaptureBytes
+	sink, err := client.Dial("tcp", "192.0.2.1:25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := "EHLO relay.example.org\r\n" + strings.Repeat("x", 5000)
+	io.WriteString(sink, sent)
+	sink.Close()
+
+	// emulate
+	web, err := client.Dial("tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(web, "GET / HTTP/1.1\r\nHost: 192.0.2.1\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(web), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Server") != fakeServerHeader {
+		t.Errorf("fake web server answered %d %q", resp.StatusCode, resp.Header.Get("Server"))
+	}
+	web.Close()
+
+	client.Close()
+	<-served
+
+	logData := readLog(t, logFile)
+	for _, want := range []string{
+		"DirectTcpip:192.0.2.1:22 from 0.0.0.0:0 policy=reject\n",
+		"DirectTcpip:192.0.2.1:25 from 0.0.0.0:0 policy=sink\n",
+		"DirectTcpip:192.0.2.1:80 from 0.0.0.0:0 policy=emulate\n",
+		"FakeService:http\n",
+		"HttpRequest:GET / HTTP/1.1",
+	} {
+		if !strings.Contains(logData, want) {
+			t.Errorf("%q not in log:\n%s", want, logData)
+		}
+	}
+	if data := readArtifact(t, logData, "tcpip-25"); data != sent[:4096] {
+		t.Errorf("sink captured %d bytes", len(data))
+	}
+	if data := readArtifact(t, logData, "conversation-80"); !strings.Contains(data, "GET / HTTP/1.1\r\n") || !strings.Contains(data, "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("conversation:\n%s", data)
+	}
+}
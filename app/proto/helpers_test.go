@@ -0,0 +1,122 @@
+package proto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testDir is a temporary directory removed along with the test.
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "antlion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// testLogFile is a session log in a directory of its own, where the
+// artifacts of the session go too.
+func testLogFile(t *testing.T) *os.File {
+	logFile, err := os.Create(filepath.Join(testDir(t), "session.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		logFile.Close()
+	})
+	return logFile
+}
+
+// readLog returns what was written to logFile so far.
+func readLog(t *testing.T, logFile *os.File) string {
+	data, err := ioutil.ReadFile(logFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// startTestServer emulates the host for an in-process ssh client, logging
+// to logFile. The returned channel is closed once the connection is over
+// and nothing writes to logFile any more.
+func startTestServer(t *testing.T, conf *Config, logFile *os.File) (*ssh.Client, <-chan struct{}) {
+	commandList, err := os.Create(filepath.Join(filepath.Dir(logFile.Name()), "commands.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		commandList.Close()
+	})
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(testSigner(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		serverConn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		sshConn, sshCh, sshGlobalRequest, err := ssh.NewServerConn(serverConn, serverConfig)
+		if err != nil {
+			return
+		}
+		serveConn(sshConn, sshCh, sshGlobalRequest, conf, logFile, commandList, Debian)
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		<-served
+	})
+	return client, served
+}
+
+// readTelnet reads in through the telnet data reader of o, and returns the
+// data left once the commands are taken out.
+func readTelnet(t *testing.T, o *telnetOptions, in []byte) string {
+	data, err := ioutil.ReadAll(newDataReader(bytes.NewReader(in), o))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// readArtifact returns the content of the artifact of kind the log names.
+func readArtifact(t *testing.T, logData string, kind string) string {
+	for _, line := range strings.Split(logData, "\n") {
+		if strings.HasPrefix(line, "Artifact:"+kind+" ") {
+			fields := strings.Fields(line)
+			data, err := ioutil.ReadFile(fields[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+	}
+	t.Fatalf("no %s artifact in log:\n%s", kind, logData)
+	return ""
+}
@@ -0,0 +1,206 @@
+package proto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyTypes are the host keys every persona offers, named like the
+// /etc/ssh/ssh_host_<type>_key files of OpenSSH.
+var hostKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+func hostKeyPath(dir string, persona string, keyType string) string {
+	return filepath.Join(dir, persona, "ssh_host_"+keyType+"_key")
+}
+
+// generateHostKey returns a new PEM encoded private key of keyType.
+func generateHostKey(keyType string) ([]byte, error) {
+	var block *pem.Block
+
+	switch keyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case "ecdsa":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 3072)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	default:
+		return nil, errors.New("unknown host key type: " + keyType)
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+// hostKeyType maps a parsed key to the file name part used for it.
+func hostKeyType(key ssh.PublicKey) string {
+	switch {
+	case key.Type() == ssh.KeyAlgoED25519:
+		return "ed25519"
+	case strings.HasPrefix(key.Type(), "ecdsa-sha2-"):
+		return "ecdsa"
+	case key.Type() == ssh.KeyAlgoRSA:
+		return "rsa"
+	}
+	return ""
+}
+
+func writeHostKey(path string, pemBytes []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, pemBytes, 0600)
+}
+
+// GenerateHostKeys creates the missing host keys of persona, or of every
+// persona when it is empty. force replaces the existing keys too.
+func GenerateHostKeys(dir string, persona string, force bool) error {
+	targets, err := personaTargets(persona)
+	if err != nil {
+		return err
+	}
+
+	for _, persona := range targets {
+		for _, keyType := range hostKeyTypes {
+			path := hostKeyPath(dir, persona, keyType)
+			if _, err := os.Stat(path); err == nil && !force {
+				continue
+			}
+
+			pemBytes, err := generateHostKey(keyType)
+			if err != nil {
+				return err
+			}
+			err = writeHostKey(path, pemBytes)
+			if err != nil {
+				return err
+			}
+			log.Print("generated " + path + "\n")
+		}
+	}
+
+	return nil
+}
+
+// ImportHostKeys copies an existing OpenSSH host key set (the
+// ssh_host_*_key files of a directory such as /etc/ssh) to persona.
+func ImportHostKeys(dir string, persona string, from string) error {
+	if persona == "" {
+		// sharing one imported set between personas would give them the same fingerprint
+		return errors.New("importing host keys needs a single persona")
+	}
+	if !isPersona(persona) {
+		return errors.New("unknown persona: " + persona)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(from, "ssh_host_*_key"))
+	if err != nil {
+		return err
+	}
+
+	imported := 0
+	for _, path := range paths {
+		pemBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			log.Print("skipping " + path + ": " + err.Error() + "\n")
+			continue
+		}
+
+		keyType := hostKeyType(signer.PublicKey())
+		if keyType == "" {
+			log.Print("skipping " + path + ": unsupported key type " + signer.PublicKey().Type() + "\n")
+			continue
+		}
+
+		err = writeHostKey(hostKeyPath(dir, persona, keyType), pemBytes)
+		if err != nil {
+			return err
+		}
+		log.Print("imported " + path + " as " + persona + " " + keyType + " key\n")
+		imported++
+	}
+
+	if imported == 0 {
+		return errors.New("no host key found in " + from)
+	}
+	return nil
+}
+
+// loadHostKeys returns the host keys of every persona, generating the
+// missing ones so that a first start needs no preparation.
+func loadHostKeys(dir string) (map[string][]ssh.Signer, error) {
+	err := GenerateHostKeys(dir, "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeys := map[string][]ssh.Signer{}
+	for _, persona := range personas {
+		for _, keyType := range hostKeyTypes {
+			path := hostKeyPath(dir, persona, keyType)
+
+			pemBytes, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+
+			signer, err := ssh.ParsePrivateKey(pemBytes)
+			if err != nil {
+				return nil, errors.New("failed to parse " + path + ": " + err.Error())
+			}
+
+			log.Print(persona + " host key " + ssh.FingerprintSHA256(signer.PublicKey()) + " (" + signer.PublicKey().Type() + ")\n")
+			hostKeys[persona] = append(hostKeys[persona], signer)
+		}
+	}
+
+	return hostKeys, nil
+}
+
+func personaTargets(persona string) ([]string, error) {
+	if persona == "" {
+		return personas, nil
+	}
+	if !isPersona(persona) {
+		return nil, errors.New("unknown persona: " + persona)
+	}
+	return []string{persona}, nil
+}
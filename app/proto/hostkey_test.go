@@ -0,0 +1,148 @@
+package proto
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fingerprints lists the host key fingerprints of each persona by key type.
+func fingerprints(hostKeys map[string][]ssh.Signer) map[string]map[string]string {
+	all := map[string]map[string]string{}
+	for persona, signers := range hostKeys {
+		all[persona] = map[string]string{}
+		for _, signer := range signers {
+			all[persona][hostKeyType(signer.PublicKey())] = ssh.FingerprintSHA256(signer.PublicKey())
+		}
+	}
+	return all
+}
+
+func TestHostKeysRoundTrip(t *testing.T) {
+	dir := testDir(t)
+
+	generated, err := loadHostKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadHostKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := fingerprints(generated), fingerprints(loaded)
+
+	seen := map[string]string{}
+	for _, persona := range personas {
+		for _, keyType := range hostKeyTypes {
+			fingerprint := first[persona][keyType]
+			if fingerprint == "" {
+				t.Errorf("%s has no %s key", persona, keyType)
+				continue
+			}
+			if second[persona][keyType] != fingerprint {
+				t.Errorf("%s %s key changed on reload", persona, keyType)
+			}
+			// a key shared between personas would link them
+			if other, ok := seen[fingerprint]; ok {
+				t.Errorf("%s %s key is the one of %s", persona, keyType, other)
+			}
+			seen[fingerprint] = persona
+		}
+	}
+
+	// forcing replaces the keys of that persona only
+	if err := GenerateHostKeys(dir, Debian, true); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = loadHostKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := fingerprints(loaded)
+	for _, persona := range personas {
+		for _, keyType := range hostKeyTypes {
+			changed := third[persona][keyType] != first[persona][keyType]
+			if changed != (persona == Debian) {
+				t.Errorf("%s %s key changed: %t", persona, keyType, changed)
+			}
+		}
+	}
+}
+
+func TestImportHostKeys(t *testing.T) {
+	dir, from := testDir(t), testDir(t)
+
+	pemBytes, err := generateHostKey("ecdsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(from, "ssh_host_ecdsa_key"), pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ImportHostKeys(dir, "", from); err == nil {
+		t.Error("imported into every persona")
+	}
+	if err := ImportHostKeys(dir, CentOS, from); err != nil {
+		t.Fatal(err)
+	}
+	hostKeys, err := loadHostKeys(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fingerprints(hostKeys)[CentOS]["ecdsa"]; got != ssh.FingerprintSHA256(signer.PublicKey()) {
+		t.Errorf("imported key not loaded, got %s", got)
+	}
+}
+
+// resetPersonaKey makes the next personaFor load the key of its conf.
+func resetPersonaKey() {
+	personaKeyOnce = sync.Once{}
+	personaKey = nil
+}
+
+func TestPersonaFor(t *testing.T) {
+	conf := DefaultConfig()
+	conf.HostKeyDir = testDir(t)
+	resetPersonaKey()
+	defer resetPersonaKey()
+
+	ips := []string{"192.0.2.1", "192.0.2.2", "198.51.100.7", "203.0.113.200", "2001:db8::1", "2001:db8::2", "10.0.0.1", "10.0.0.2"}
+	pinned := map[string]string{}
+	used := map[string]bool{}
+	for _, ip := range ips {
+		pinned[ip] = personaFor(ip, conf)
+		used[pinned[ip]] = true
+		if !isPersona(pinned[ip]) {
+			t.Errorf("%s got %q", ip, pinned[ip])
+		}
+	}
+	if len(used) < 2 {
+		t.Errorf("every address got %v", used)
+	}
+
+	for _, ip := range ips {
+		if persona := personaFor(ip, conf); persona != pinned[ip] {
+			t.Errorf("%s moved from %s to %s", ip, pinned[ip], persona)
+		}
+	}
+
+	// the key is kept, a restart shows the same personas
+	if _, err := os.Stat(filepath.Join(conf.HostKeyDir, "persona.key")); err != nil {
+		t.Fatal(err)
+	}
+	resetPersonaKey()
+	for _, ip := range ips {
+		if persona := personaFor(ip, conf); persona != pinned[ip] {
+			t.Errorf("%s moved from %s to %s after a restart", ip, pinned[ip], persona)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package proto
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// What to do with a connection over one of the limits.
+const (
+	LimitDrop   = "drop"   // close it right away
+	LimitTarpit = "tarpit" // hold it in the tarpit
+	LimitBanner = "banner" // greet it like a busy server, then close it
+)
+
+// LimitAction is one of the Limit constants, usable as a flag.
+type LimitAction string
+
+func (a *LimitAction) String() string {
+	if a == nil {
+		return ""
+	}
+	return string(*a)
+}
+
+func (a *LimitAction) Set(value string) error {
+	switch value {
+	case LimitDrop, LimitTarpit, LimitBanner:
+		*a = LimitAction(value)
+		return nil
+	}
+	return fmt.Errorf("unknown limit action %q", value)
+}
+
+// Reasons for refusing a connection, also used as counter names.
+const (
+	limitGlobal = "global"
+	limitPerIP  = "per_ip"
+	limitRate   = "rate"
+)
+
+// connection counters, served on /debug/vars when a stats address is set.
+var connStats = expvar.NewMap("connections")
+
+// tokenBucket allows burst connections at once, refilled by rate per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connLimiter caps the connections of both listeners, in total and per source IP.
+type connLimiter struct {
+	mu      sync.Mutex
+	conf    *Config
+	total   int
+	perIP   map[string]int
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	tarpits int
+	// the clock of the rate limit, replaced by tests
+	now func() time.Time
+}
+
+var (
+	limiter     *connLimiter
+	limiterOnce sync.Once
+)
+
+// sharedLimiter returns the limiter of the process, file descriptors being
+// shared by the ssh and telnet listeners.
+func sharedLimiter(conf *Config) *connLimiter {
+	limiterOnce.Do(func() {
+		limiter = newConnLimiter(conf, time.Now)
+	})
+	return limiter
+}
+
+func newConnLimiter(conf *Config, now func() time.Time) *connLimiter {
+	return &connLimiter{
+		conf:    conf,
+		perIP:   map[string]int{},
+		buckets: map[string]*tokenBucket{},
+		swept:   now(),
+		now:     now,
+	}
+}
+
+// admitGlobal counts a new connection against the total. It returns the
+// reason to refuse it, or "" when it is let in and releaseGlobal must be
+// called once it is closed.
+func (l *connLimiter) admitGlobal() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conf.MaxConns > 0 && l.total >= l.conf.MaxConns {
+		return limitGlobal
+	}
+	l.total++
+	return ""
+}
+
+func (l *connLimiter) releaseGlobal() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+}
+
+// admit counts a new connection from ip, already counted by admitGlobal.
+// It returns the reason to refuse it, or "" when it is let in and release
+// must be called once it is closed.
+func (l *connLimiter) admit(ip string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	// checked first, a connection refused for it does not spend a token
+	if l.conf.MaxConnsPerIP > 0 && l.perIP[ip] >= l.conf.MaxConnsPerIP {
+		return limitPerIP
+	}
+	if l.conf.ConnRate > 0 {
+		bucket, ok := l.buckets[ip]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(l.conf.ConnBurst), last: now}
+			l.buckets[ip] = bucket
+		}
+		if !bucket.take(now, l.conf.ConnRate, l.conf.ConnBurst) {
+			return limitRate
+		}
+	}
+
+	l.perIP[ip]++
+	return ""
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// sweep forgets the buckets that have refilled, so that a scan of many
+// addresses does not grow the map forever.
+func (l *connLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+
+	for ip, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.conf.ConnRate >= float64(l.conf.ConnBurst) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// startTarpit reserves one of the tarpit slots, which hold a file descriptor each.
+func (l *connLimiter) startTarpit() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tarpits >= l.conf.MaxTarpits {
+		return false
+	}
+	l.tarpits++
+	return true
+}
+
+func (l *connLimiter) stopTarpit() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tarpits--
+}
+
+// acceptGlobal counts conn against the total of both listeners, as soon as
+// it is accepted and before anything is read from it. When the limit is
+// reached, conn is handled according to the limit action and closed,
+// banner being what a busy server would send, and ok is false. Otherwise
+// done must be called when conn is closed.
+func acceptGlobal(conn net.Conn, kind string, conf *Config, banner string) (done func(), ok bool) {
+	return sharedLimiter(conf).acceptGlobal(conn, kind, banner)
+}
+
+func (l *connLimiter) acceptGlobal(conn net.Conn, kind string, banner string) (done func(), ok bool) {
+	reason := l.admitGlobal()
+	if reason == "" {
+		return onlyOnce(l.releaseGlobal), true
+	}
+
+	overLimit(conn, kind, reason, l.conf, banner)
+	return nil, false
+}
+
+// acceptLimited lets conn in through the per address limits, counting it
+// under kind ("ssh" or "telnet"). It comes after acceptGlobal and the PROXY
+// header, once the address of the client is known, and handles conn the
+// same way when it is over a limit.
+func acceptLimited(conn net.Conn, kind string, conf *Config, banner string) (done func(), ok bool) {
+	return sharedLimiter(conf).acceptLimited(conn, kind, banner)
+}
+
+func (l *connLimiter) acceptLimited(conn net.Conn, kind string, banner string) (done func(), ok bool) {
+	ip := remoteIPOf(conn)
+
+	reason := l.admit(ip)
+	if reason == "" {
+		connStats.Add(kind+".accepted", 1)
+		connStats.Add(kind+".active", 1)
+		return onlyOnce(func() {
+			l.release(ip)
+			connStats.Add(kind+".active", -1)
+		}), true
+	}
+
+	overLimit(conn, kind, reason, l.conf, banner)
+	return nil, false
+}
+
+// onlyOnce makes a done func safe to call early, as when the connection goes
+// to the tarpit, and again when it is closed.
+func onlyOnce(f func()) func() {
+	var once sync.Once
+	return func() {
+		once.Do(f)
+	}
+}
+
+// overLimit applies the limit action to conn.
+func overLimit(conn net.Conn, kind string, reason string, conf *Config, banner string) {
+	connStats.Add(kind+".rejected."+reason, 1)
+
+	action := string(conf.LimitAction)
+	log.Print(kind + " connection from " + conn.RemoteAddr().String() + " over the " + reason + " limit, " + action + "\n")
+
+	switch action {
+	case LimitTarpit:
+		go func() {
+			// when every tarpit slot is taken, holding more would defeat the limit
+			if !tarpit(conn, kind, reason+" limit", conf, nil) {
+				conn.Close()
+			}
+		}()
+		return
+	case LimitBanner:
+		conn.SetWriteDeadline(time.Now().Add(conf.HandshakeTimeout))
+		io.WriteString(conn, banner)
+	}
+	conn.Close()
+}
+
+// remoteIPOf returns the address of the client of conn without its port.
+func remoteIPOf(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,175 @@
+package proto
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+)
+
+// testClock is a clock moved by hand.
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestLimiter(conf *Config) (*connLimiter, *testClock) {
+	clock := &testClock{t: time.Unix(1600000000, 0)}
+	return newConnLimiter(conf, clock.now), clock
+}
+
+func expectAdmit(t *testing.T, l *connLimiter, ip string, want string) {
+	t.Helper()
+	if reason := l.admit(ip); reason != want {
+		t.Fatalf("admit(%s) = %q, want %q", ip, reason, want)
+	}
+}
+
+func TestLimiterPerIP(t *testing.T) {
+	l, _ := newTestLimiter(&Config{MaxConnsPerIP: 2})
+
+	expectAdmit(t, l, "192.0.2.1", "")
+	expectAdmit(t, l, "192.0.2.1", "")
+	expectAdmit(t, l, "192.0.2.1", limitPerIP)
+	expectAdmit(t, l, "192.0.2.2", "")
+
+	l.release("192.0.2.1")
+	expectAdmit(t, l, "192.0.2.1", "")
+
+	l.release("192.0.2.1")
+	l.release("192.0.2.1")
+	l.release("192.0.2.2")
+	if len(l.perIP) != 0 {
+		t.Errorf("addresses left after release: %v", l.perIP)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l, clock := newTestLimiter(&Config{ConnRate: 2, ConnBurst: 3})
+
+	for i := 0; i < 3; i++ {
+		expectAdmit(t, l, "192.0.2.1", "")
+	}
+	expectAdmit(t, l, "192.0.2.1", limitRate)
+	// buckets are per address
+	expectAdmit(t, l, "192.0.2.2", "")
+
+	clock.advance(250 * time.Millisecond)
+	expectAdmit(t, l, "192.0.2.1", limitRate)
+	clock.advance(250 * time.Millisecond)
+	expectAdmit(t, l, "192.0.2.1", "")
+	expectAdmit(t, l, "192.0.2.1", limitRate)
+
+	// a long pause refills the burst and no more
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		expectAdmit(t, l, "192.0.2.1", "")
+	}
+	expectAdmit(t, l, "192.0.2.1", limitRate)
+}
+
+func TestLimiterPerIPBeforeRate(t *testing.T) {
+	l, clock := newTestLimiter(&Config{MaxConnsPerIP: 1, ConnRate: 1, ConnBurst: 1})
+
+	expectAdmit(t, l, "192.0.2.1", "")
+	clock.advance(time.Second)
+	// refused for the open connection, keeping the token that came meanwhile
+	expectAdmit(t, l, "192.0.2.1", limitPerIP)
+	expectAdmit(t, l, "192.0.2.1", limitPerIP)
+	l.release("192.0.2.1")
+	expectAdmit(t, l, "192.0.2.1", "")
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l, clock := newTestLimiter(&Config{ConnRate: 1, ConnBurst: 5})
+
+	expectAdmit(t, l, "192.0.2.1", "")
+	clock.advance(2 * time.Minute)
+	expectAdmit(t, l, "192.0.2.2", "")
+	if _, ok := l.buckets["192.0.2.1"]; ok || len(l.buckets) != 1 {
+		t.Errorf("refilled bucket kept: %v", l.buckets)
+	}
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	l, _ := newTestLimiter(&Config{MaxConns: 2})
+
+	for i := 0; i < 2; i++ {
+		if reason := l.admitGlobal(); reason != "" {
+			t.Fatalf("connection %d refused: %s", i, reason)
+		}
+	}
+	if reason := l.admitGlobal(); reason != limitGlobal {
+		t.Fatalf("third connection: %q", reason)
+	}
+	l.releaseGlobal()
+	if reason := l.admitGlobal(); reason != "" {
+		t.Fatalf("connection refused after release: %s", reason)
+	}
+}
+
+func connStat(name string) int64 {
+	if v, ok := connStats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestLimiterStats(t *testing.T) {
+	l, _ := newTestLimiter(&Config{MaxConns: 2, MaxConnsPerIP: 1, LimitAction: LimitDrop})
+	accepted := connStat("test.accepted")
+	perIP := connStat("test.rejected.per_ip")
+	global := connStat("test.rejected.global")
+
+	pipe := func() net.Conn {
+		client, server := net.Pipe()
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+		return server
+	}
+
+	releaseFirst, ok := l.acceptGlobal(pipe(), "test", "")
+	if !ok {
+		t.Fatal("first connection refused")
+	}
+	done, ok := l.acceptLimited(pipe(), "test", "")
+	if !ok {
+		t.Fatal("first connection refused by address")
+	}
+	if connStat("test.accepted") != accepted+1 || connStat("test.active") != 1 {
+		t.Errorf("accepted %d active %d", connStat("test.accepted")-accepted, connStat("test.active"))
+	}
+
+	// net.Pipe addresses all look the same
+	releaseSecond, ok := l.acceptGlobal(pipe(), "test", "")
+	if !ok {
+		t.Fatal("second connection refused")
+	}
+	if _, ok := l.acceptLimited(pipe(), "test", ""); ok {
+		t.Error("second connection from the address let in")
+	}
+	if _, ok := l.acceptGlobal(pipe(), "test", ""); ok {
+		t.Error("third connection let in")
+	}
+	if connStat("test.rejected.per_ip") != perIP+1 || connStat("test.rejected.global") != global+1 {
+		t.Errorf("rejected per_ip %d global %d", connStat("test.rejected.per_ip")-perIP, connStat("test.rejected.global")-global)
+	}
+
+	// done is safe to call twice, as when a connection leaves the tarpit
+	done()
+	done()
+	releaseFirst()
+	releaseSecond()
+	if connStat("test.active") != 0 || l.total != 0 || len(l.perIP) != 0 {
+		t.Errorf("active %d total %d per address %v after release", connStat("test.active"), l.total, l.perIP)
+	}
+}
@@ -0,0 +1,167 @@
+package proto
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AddrList is a set of listen addresses, as a flag "0.0.0.0:2222,[::]:2222".
+type AddrList []string
+
+func (l *AddrList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *AddrList) Set(value string) error {
+	addrs := AddrList{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			return err
+		}
+		addrs = append(addrs, v)
+	}
+	// the flag replaces the default instead of adding to it
+	*l = addrs
+	return nil
+}
+
+// listenAll listens on every address of addrs and returns a listener
+// accepting the connections of all of them. ":2222" alone is dual-stack
+// on most systems, "0.0.0.0:2222,[::]:2222" covers the others.
+func listenAll(addrs AddrList) (net.Listener, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen address")
+	}
+
+	m := &multiListener{
+		conns:  make(chan net.Conn),
+		errs:   make(chan error),
+		closed: make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.listeners = append(m.listeners, l)
+	}
+	for _, l := range m.listeners {
+		go m.accept(l)
+	}
+	return m, nil
+}
+
+// multiListener merges the connections of several listeners.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	once      sync.Once
+}
+
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case m.errs <- err:
+			case <-m.closed:
+				return
+			}
+			continue
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.closed:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.once.Do(func() {
+		close(m.closed)
+		for _, l := range m.listeners {
+			l.Close()
+		}
+	})
+	return nil
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// sessionLogLayout names the session logs: RFC 3339 in its basic format,
+// without the ":" some file systems refuse, and sorting by time.
+const sessionLogLayout = "20060102T150405.000000000Z"
+
+// maxSessionLogSuffix bounds the tries to find a free session log name.
+const maxSessionLogSuffix = 100
+
+// createSessionLog creates the log file of a session started at t, in the
+// directory of its client under root. The path is made of the parsed
+// address only, so that nothing the client sends ends up in it.
+func createSessionLog(root string, addr net.Addr, t time.Time) (*os.File, error) {
+	dir := filepath.Join(root, addrDirName(addr))
+	err := os.MkdirAll(dir, 0766)
+	if err != nil {
+		return nil, err
+	}
+
+	// sessions starting in the same nanosecond, or a clock going back,
+	// get a suffix rather than sharing a log; "_" sorts after ".txt"
+	base := filepath.Join(dir, t.UTC().Format(sessionLogLayout))
+	name := base + ".txt"
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) || i > maxSessionLogSuffix {
+			return f, err
+		}
+		name = base + "_" + strconv.Itoa(i) + ".txt"
+	}
+}
+
+// addrDirName is the directory name of the host of addr: the address as is
+// for IPv4 (IPv4-mapped IPv6 included), with "_" in place of ":" for IPv6,
+// which is not a valid file name character everywhere.
+func addrDirName(addr net.Addr) string {
+	var ip net.IP
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	} else if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		ip = net.ParseIP(host)
+	}
+
+	if ip == nil {
+		return "unknown"
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	return strings.Replace(ip.String(), ":", "_", -1)
+}
@@ -0,0 +1,42 @@
+package proto
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateSessionLog(t *testing.T) {
+	root := testDir(t)
+
+	start := time.Date(2021, 5, 3, 14, 7, 9, 12345, time.FixedZone("CEST", 2*60*60))
+	tests := []struct {
+		addr net.Addr
+		path string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}, "192.0.2.1/20210503T120709.000012345Z.txt"},
+		// a second session in the same nanosecond gets a log of its own
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 40000}, "192.0.2.1/20210503T120709.000012345Z_1.txt"},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40001}, "192.0.2.1/20210503T120709.000012345Z_2.txt"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, "2001_db8__1/20210503T120709.000012345Z.txt"},
+		{tunnelAddr("not an address"), "unknown/20210503T120709.000012345Z.txt"},
+	}
+
+	for _, tt := range tests {
+		f, err := createSessionLog(root, tt.addr, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		rel, _ := filepath.Rel(root, f.Name())
+		if filepath.ToSlash(rel) != tt.path {
+			t.Errorf("log of %s at %s, want %s", tt.addr, rel, tt.path)
+		}
+		if strings.Contains(rel, ":") {
+			t.Errorf("%s has a colon", rel)
+		}
+	}
+}
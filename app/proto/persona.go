@@ -0,0 +1,161 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// personas are the systems the honeypot pretends to be, one of them is
+// picked per client address before the handshake.
+var personas = []string{Ubuntu, KaliLinux, RaspberryPi, AmazonLinux, CentOS, Debian}
+
+var (
+	personaKey     []byte
+	personaKeyOnce sync.Once
+)
+
+// sharedPersonaKey returns the key of the persona mapping, kept next to
+// the host keys so that a restart does not change the persona of a client.
+func sharedPersonaKey(conf *Config) []byte {
+	personaKeyOnce.Do(func() {
+		path := filepath.Join(conf.HostKeyDir, "persona.key")
+
+		key, err := ioutil.ReadFile(path)
+		if err == nil && len(key) >= 16 {
+			personaKey = key
+			return
+		}
+
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal("failed to create the persona key:", err)
+		}
+		personaKey = key
+
+		err = os.MkdirAll(conf.HostKeyDir, 0700)
+		if err == nil {
+			err = ioutil.WriteFile(path, key, 0600)
+		}
+		if err != nil {
+			log.Print("failed to save the persona key, personas change on restart:", err.Error()+"\n")
+		}
+	})
+	return personaKey
+}
+
+// personaFor returns the persona shown to the client at ip: the same one on
+// every connection and on both listeners, a host key or a kernel changing
+// between two connections being a giveaway. The mapping is keyed so that it
+// cannot be worked out from the addresses.
+func personaFor(ip string, conf *Config) string {
+	mac := hmac.New(sha256.New, sharedPersonaKey(conf))
+	mac.Write([]byte(ip))
+	sum := mac.Sum(nil)
+	return personas[binary.BigEndian.Uint32(sum)%uint32(len(personas))]
+}
+
+func isPersona(name string) bool {
+	for _, persona := range personas {
+		if persona == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sshProfile is what the sshd of a persona shows in its version string and
+// KEXINIT, so that tools like ssh-audit see a server matching the claimed system.
+type sshProfile struct {
+	version           string
+	keyExchanges      []string
+	ciphers           []string
+	macs              []string
+	hostKeyAlgorithms []string
+}
+
+// the algorithm lists are the defaults of the OpenSSH release each system
+// shipped with, in its order of preference.
+var sshProfiles = map[string]sshProfile{
+	Ubuntu: {
+		version:           "SSH-2.0-OpenSSH_7.2p2 Ubuntu-4ubuntu2.8",
+		keyExchanges:      []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group-exchange-sha256", "diffie-hellman-group14-sha1"},
+		ciphers:           []string{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com"},
+		macs:              []string{"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com", "umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1"},
+		hostKeyAlgorithms: []string{"ssh-rsa", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+	},
+	KaliLinux: {
+		version:           "SSH-2.0-OpenSSH_7.8p1 Debian-1",
+		keyExchanges:      []string{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512", "diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1"},
+		ciphers:           []string{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com"},
+		macs:              []string{"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com", "umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1"},
+		hostKeyAlgorithms: []string{"ssh-rsa", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+	},
+	RaspberryPi: {
+		version:           "SSH-2.0-OpenSSH_7.4p1 Raspbian-10+deb9u2",
+		keyExchanges:      []string{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512", "diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1"},
+		ciphers:           []string{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com"},
+		macs:              []string{"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com", "umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1"},
+		hostKeyAlgorithms: []string{"ssh-rsa", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+	},
+	AmazonLinux: {
+		version:           "SSH-2.0-OpenSSH_7.4",
+		keyExchanges:      []string{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512", "diffie-hellman-group-exchange-sha1", "diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1"},
+		ciphers:           []string{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-cbc", "aes192-cbc", "aes256-cbc", "blowfish-cbc", "cast128-cbc", "3des-cbc"},
+		macs:              []string{"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com", "umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1"},
+		hostKeyAlgorithms: []string{"ssh-rsa", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+	},
+	CentOS: {
+		version:           "SSH-2.0-OpenSSH_7.4",
+		keyExchanges:      []string{"curve25519-sha256", "curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group-exchange-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group18-sha512", "diffie-hellman-group-exchange-sha1", "diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1"},
+		ciphers:           []string{"chacha20-poly1305@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-cbc", "aes192-cbc", "aes256-cbc", "blowfish-cbc", "cast128-cbc", "3des-cbc"},
+		macs:              []string{"umac-64-etm@openssh.com", "umac-128-etm@openssh.com", "hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com", "hmac-sha1-etm@openssh.com", "umac-64@openssh.com", "umac-128@openssh.com", "hmac-sha2-256", "hmac-sha2-512", "hmac-sha1"},
+		hostKeyAlgorithms: []string{"ssh-rsa", "ecdsa-sha2-nistp256", "ssh-ed25519"},
+	},
+	Debian: {
+		// wheezy's OpenSSH 6.0 predates ed25519 and chacha20
+		version:           "SSH-2.0-OpenSSH_6.0p1 Debian-4+deb7u2",
+		keyExchanges:      []string{"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1"},
+		ciphers:           []string{"aes128-ctr", "aes192-ctr", "aes256-ctr", "arcfour256", "arcfour128", "aes128-cbc", "3des-cbc", "blowfish-cbc", "cast128-cbc", "aes192-cbc", "aes256-cbc", "arcfour"},
+		macs:              []string{"hmac-md5", "hmac-sha1", "umac-64@openssh.com", "hmac-sha2-256", "hmac-sha2-256-96", "hmac-sha2-512", "hmac-sha2-512-96", "hmac-ripemd160", "hmac-ripemd160@openssh.com", "hmac-sha1-96", "hmac-md5-96"},
+		hostKeyAlgorithms: []string{"ssh-rsa", "ecdsa-sha2-nistp256"},
+	},
+}
+
+// the algorithms golang.org/x/crypto/ssh implements on the server side. The
+// profiles are cut down to them, as offering any other would let a client
+// pick something the handshake cannot complete with.
+var (
+	supportedKeyExchanges = []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1"}
+	supportedCiphers      = []string{"aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com", "arcfour256", "arcfour128", "arcfour", "aes128-cbc", "3des-cbc"}
+	supportedMACs         = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"}
+)
+
+func supportedOnly(algorithms []string, supported []string) []string {
+	result := []string{}
+	for _, algorithm := range algorithms {
+		for _, s := range supported {
+			if algorithm == s {
+				result = append(result, algorithm)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// hostnames the personas report, matching their uname -a output.
+var hostnames = map[string]string{
+	Ubuntu:      "ubuntu",
+	KaliLinux:   "kali",
+	RaspberryPi: "raspberrypi",
+	AmazonLinux: "ip-170-31-81-10",
+	CentOS:      "cent",
+	Debian:      "debian",
+}
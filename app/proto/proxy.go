@@ -0,0 +1,354 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Backend is a real ssh server, such as a disposable container or VM, that
+// authenticated clients are relayed to in proxy mode. Without User, the
+// client's own user name and password are passed on.
+type Backend struct {
+	Addr     string
+	User     string
+	Password string
+}
+
+// BackendList is the set of backends, as a repeatable flag "user:password@host:port" or "host:port".
+type BackendList []Backend
+
+func (l *BackendList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := []string{}
+	for _, b := range *l {
+		if b.User != "" {
+			s = append(s, b.User+"@"+b.Addr)
+		} else {
+			s = append(s, b.Addr)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *BackendList) Set(value string) error {
+	b := Backend{Addr: value}
+	if i := strings.LastIndex(value, "@"); i >= 0 {
+		b.Addr = value[i+1:]
+		b.User = value[:i]
+		if j := strings.Index(b.User, ":"); j >= 0 {
+			b.Password = b.User[j+1:]
+			b.User = b.User[:j]
+		}
+	}
+	if _, _, err := net.SplitHostPort(b.Addr); err != nil {
+		return err
+	}
+	*l = append(*l, b)
+	return nil
+}
+
+// backendPool hands out each backend to one session at a time, so that
+// what a client does in its sandbox is not seen by the next one.
+type backendPool struct {
+	free chan Backend
+}
+
+func newBackendPool(backends BackendList) *backendPool {
+	p := &backendPool{
+		free: make(chan Backend, len(backends)),
+	}
+	for _, b := range backends {
+		p.free <- b
+	}
+	return p
+}
+
+// acquire returns a free backend, ok is false when they are all taken.
+func (p *backendPool) acquire() (b Backend, ok bool) {
+	select {
+	case b = <-p.free:
+		return b, true
+	default:
+		return Backend{}, false
+	}
+}
+
+func (p *backendPool) release(b Backend) {
+	p.free <- b
+}
+
+// proxySession relays an authenticated connection to a backend of the pool
+// until it is over. It returns false, having done nothing, when no backend
+// is available and the connection is left to the emulation.
+func proxySession(pool *backendPool, sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, auth *connAuth, conf *Config, logFile *os.File, commandList *os.File) bool {
+	backend, ok := pool.acquire()
+	if !ok {
+		log.Print("no free backend for " + sshConn.RemoteAddr().String() + ", emulating\n")
+		return false
+	}
+	defer pool.release(backend)
+
+	backendConn, backendChans, backendReqs, err := dialBackend(backend, sshConn.User(), auth.password, string(sshConn.ClientVersion()), conf.HandshakeTimeout, logFile)
+	if err != nil {
+		log.Print("backend "+backend.Addr+" failed:", err.Error()+"\n")
+		return false
+	}
+
+	fmt.Fprint(logFile, "Backend:"+backend.Addr+"\n")
+	fmt.Fprint(logFile, "BackendVersion:"+string(backendConn.ServerVersion())+"\n")
+
+	proxyConn(sshConn, chans, reqs, backendConn, backendChans, backendReqs, logFile, commandList)
+	return true
+}
+
+// dialBackend logs in to b as the client did, with its version string, so
+// that the backend sees what it would have seen without the proxy.
+func dialBackend(b Backend, user string, password string, clientVersion string, timeout time.Duration, logFile *os.File) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	if b.User != "" {
+		user = b.User
+		password = b.Password
+	}
+
+	conn, err := net.DialTimeout("tcp", b.Addr, timeout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}),
+		},
+		// the backend is ours and disposable, its key is only recorded
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fmt.Fprint(logFile, "BackendHostKey:"+ssh.FingerprintSHA256(key)+"\n")
+			return nil
+		},
+		ClientVersion: clientVersion,
+	}
+
+	backendConn, chans, reqs, err := ssh.NewClientConn(conn, b.Addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return backendConn, chans, reqs, nil
+}
+
+// proxyConn relays everything between an authenticated client and its
+// backend until one of them hangs up: channels and global requests opened
+// by either side, with the traffic recorded in the session log and artifacts.
+func proxyConn(client ssh.Conn, clientChans <-chan ssh.NewChannel, clientReqs <-chan *ssh.Request, backend ssh.Conn, backendChans <-chan ssh.NewChannel, backendReqs <-chan *ssh.Request, logFile *os.File, commandList *os.File) {
+	go relayGlobalRequests(clientReqs, backend, "-->", logFile)
+	go relayGlobalRequests(backendReqs, client, "<--", logFile)
+	go relayChannels(backendChans, client, false, logFile, commandList)
+	go relayChannels(clientChans, backend, true, logFile, commandList)
+
+	go func() {
+		backend.Wait()
+		client.Close()
+	}()
+	client.Wait()
+	backend.Close()
+}
+
+func relayGlobalRequests(reqs <-chan *ssh.Request, to ssh.Conn, direction string, logFile *os.File) {
+	for r := range reqs {
+		ok, payload, err := to.SendRequest(r.Type, r.WantReply, r.Payload)
+		if err != nil {
+			log.Print("relay global request failed:", err.Error()+"\n")
+		}
+		fmt.Fprintf(logFile, "ProxyGlobalRequest:%s %q %x ok=%t\n", direction, r.Type, r.Payload, ok)
+		r.Reply(ok, payload)
+	}
+}
+
+// relayChannels opens every channel coming from one side on the other one.
+// fromClient tells which side the channels come from.
+func relayChannels(chans <-chan ssh.NewChannel, to ssh.Conn, fromClient bool, logFile *os.File, commandList *os.File) {
+	for c := range chans {
+		go func(newChannel ssh.NewChannel) {
+			err := relayChannel(newChannel, to, fromClient, logFile, commandList)
+			if err != nil {
+				log.Print("relay channel error:", err.Error()+"\n")
+			}
+		}(c)
+	}
+}
+
+// maxProxyConversation is how much of the traffic of a relayed channel is
+// recorded, the relay itself goes on past it.
+const maxProxyConversation = 16 * 1024 * 1024
+
+// channels whose type may name their artifacts, the others being client controlled.
+var proxyChannelKinds = map[string]bool{
+	"session":         true,
+	"direct-tcpip":    true,
+	"forwarded-tcpip": true,
+	"x11":             true,
+}
+
+func relayChannel(newChannel ssh.NewChannel, to ssh.Conn, fromClient bool, logFile *os.File, commandList *os.File) error {
+	direction := "<--"
+	if fromClient {
+		direction = "-->"
+	}
+	channelType := newChannel.ChannelType()
+	fmt.Fprintf(logFile, "ProxyChannel:%s %q %x\n", direction, channelType, newChannel.ExtraData())
+
+	peer, peerReqs, err := to.OpenChannel(channelType, newChannel.ExtraData())
+	if err != nil {
+		// the client gets the backend's answer, and the backend the client's
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			return newChannel.Reject(openErr.Reason, openErr.Message)
+		}
+		newChannel.Reject(ssh.ConnectionFailed, "open failed")
+		return err
+	}
+
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		peer.Close()
+		return err
+	}
+
+	// from here on, clientCh is the end facing the client and backendCh the
+	// one facing the backend, whoever opened the channel
+	clientCh, clientReqs, backendCh, backendReqs := ch, reqs, peer, peerReqs
+	if !fromClient {
+		clientCh, clientReqs, backendCh, backendReqs = peer, peerReqs, ch, reqs
+	}
+
+	kind := "channel"
+	if proxyChannelKinds[channelType] {
+		kind = channelType
+	}
+	conversation, err := newConversation(logFile, "proxy-"+kind, maxProxyConversation)
+	if err != nil {
+		clientCh.Close()
+		backendCh.Close()
+		return err
+	}
+	defer conversation.Close()
+
+	recorder := newSessionRecorder(logFile, commandList)
+
+	toBackend := relayData(backendCh, clientCh, func(p []byte) {
+		conversation.record("-->", p)
+		recorder.clientData(p)
+	})
+	toClient := relayData(clientCh, backendCh, func(p []byte) {
+		conversation.record("<--", p)
+		recorder.serverData(p)
+	})
+	stderrToClient := make(chan struct{})
+	go func() {
+		io.Copy(clientCh.Stderr(), &recordingReader{backendCh.Stderr(), func(p []byte) {
+			conversation.record("<-2", p)
+		}})
+		close(stderrToClient)
+	}()
+
+	// the client gets its EOF once both stdout and stderr are done, stderr
+	// written after it would be refused
+	clientEOF := make(chan struct{})
+	go func() {
+		<-toClient
+		<-stderrToClient
+		clientCh.CloseWrite()
+		close(clientEOF)
+	}()
+	go func() {
+		<-toBackend
+		backendCh.CloseWrite()
+	}()
+
+	// exit-status and exit-signal come after the output, which has to
+	// reach the client first
+	outputSent := func() {
+		<-clientEOF
+	}
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		relayChannelRequests(backendReqs, clientCh, "<--", recorder, logFile, outputSent)
+		outputSent()
+		clientCh.Close()
+		wg.Done()
+	}()
+	go func() {
+		relayChannelRequests(clientReqs, backendCh, "-->", recorder, logFile, nil)
+		<-toBackend
+		backendCh.Close()
+		wg.Done()
+	}()
+	wg.Wait()
+
+	recorder.finish()
+	return nil
+}
+
+// relayData copies from src to dst, passing every chunk to record. The
+// returned channel is closed once src is exhausted, the EOF being left to
+// the caller.
+func relayData(dst ssh.Channel, src ssh.Channel, record func([]byte)) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(dst, &recordingReader{src, record})
+		close(done)
+	}()
+	return done
+}
+
+// relayChannelRequests passes the requests of a channel on to its other
+// end. Exit requests wait for outputSent when it is given.
+func relayChannelRequests(reqs <-chan *ssh.Request, to ssh.Channel, direction string, recorder *sessionRecorder, logFile *os.File, outputSent func()) {
+	for r := range reqs {
+		if direction == "-->" {
+			recorder.request(r.Type, r.Payload)
+		}
+		if outputSent != nil && (r.Type == "exit-status" || r.Type == "exit-signal") {
+			outputSent()
+		}
+		ok, err := to.SendRequest(r.Type, r.WantReply, r.Payload)
+		if err != nil {
+			log.Print("relay channel request failed:", err.Error()+"\n")
+		}
+		fmt.Fprintf(logFile, "ProxyRequest:%s %q %x ok=%t\n", direction, r.Type, r.Payload, ok)
+		r.Reply(ok, nil)
+	}
+}
+
+type recordingReader struct {
+	r      io.Reader
+	record func([]byte)
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.record(p[:n])
+	}
+	return n, err
+}
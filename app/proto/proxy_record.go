@@ -0,0 +1,329 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionRecorder follows a relayed channel to log what the client does
+// in the backend: the commands typed into a shell, the exec commands, and
+// the files moved with scp and sftp.
+type sessionRecorder struct {
+	mu          sync.Mutex
+	logFile     *os.File
+	commandList *os.File
+
+	mode string
+
+	// shell input
+	line   []byte
+	escape int
+
+	// file transfers
+	scp  *scpStream
+	sftp []byte
+}
+
+// what a session channel turned out to run.
+const (
+	recordShell       = "shell"
+	recordExec        = "exec"
+	recordSCPUpload   = "scp upload"
+	recordSCPDownload = "scp download"
+	recordSFTP        = "sftp"
+)
+
+// longest shell line and scp header kept, longer ones are cut.
+const maxRecordedLine = 4096
+
+// largest sftp packet parsed, bigger means the stream is not sftp after all.
+const maxSFTPPacket = 1 << 20
+
+func newSessionRecorder(logFile *os.File, commandList *os.File) *sessionRecorder {
+	return &sessionRecorder{
+		logFile:     logFile,
+		commandList: commandList,
+	}
+}
+
+// request notes a request the client made on the channel.
+func (r *sessionRecorder) request(requestType string, payload []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch requestType {
+	case "shell":
+		r.mode = recordShell
+	case "exec":
+		var msg execMsg
+		if ssh.Unmarshal(payload, &msg) != nil {
+			return
+		}
+		logCommand(msg.Command, r.logFile, r.commandList)
+
+		r.mode = recordExec
+		fields := strings.Fields(msg.Command)
+		if len(fields) > 0 && fields[0] == "scp" {
+			for _, f := range fields[1:] {
+				if f == "-t" {
+					r.mode = recordSCPUpload
+				} else if f == "-f" {
+					r.mode = recordSCPDownload
+				}
+			}
+			if r.mode != recordExec {
+				r.scp = &scpStream{}
+			}
+		}
+	case "subsystem":
+		var msg subsystemRequestMsg
+		if ssh.Unmarshal(payload, &msg) != nil {
+			return
+		}
+		fmt.Fprint(r.logFile, "Subsystem:"+msg.Subsystem+"\n")
+		if msg.Subsystem == "sftp" {
+			r.mode = recordSFTP
+		}
+	}
+}
+
+// clientData is what the client sent on the channel.
+func (r *sessionRecorder) clientData(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch r.mode {
+	case recordShell:
+		r.typed(p)
+	case recordSCPUpload:
+		r.scp.feed(p, r.mode, r.logFile)
+	case recordSFTP:
+		r.sftpData(p)
+	}
+}
+
+// serverData is what the backend sent on the channel.
+func (r *sessionRecorder) serverData(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.mode == recordSCPDownload {
+		r.scp.feed(p, r.mode, r.logFile)
+	}
+}
+
+// finish logs the line the client was typing when the channel closed.
+func (r *sessionRecorder) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(bytes.TrimSpace(r.line)) > 0 {
+		logCommand(string(r.line), r.logFile, r.commandList)
+	}
+}
+
+// typed applies keystrokes to the current line the way a shell's line
+// editor roughly would, and logs each line entered.
+func (r *sessionRecorder) typed(p []byte) {
+	for _, b := range p {
+		if r.escape == 1 {
+			// ESC [ and ESC O start a sequence, anything else is a single key
+			if b == '[' || b == 'O' {
+				r.escape = 2
+			} else {
+				r.escape = 0
+			}
+			continue
+		}
+		if r.escape == 2 {
+			if b >= 0x40 && b <= 0x7e {
+				r.escape = 0
+			}
+			continue
+		}
+
+		switch b {
+		case '\r', '\n':
+			if len(bytes.TrimSpace(r.line)) > 0 {
+				logCommand(string(r.line), r.logFile, r.commandList)
+			}
+			r.line = r.line[:0]
+		case 0x7f, 0x08: // DEL, BS
+			for len(r.line) > 0 {
+				last := r.line[len(r.line)-1]
+				r.line = r.line[:len(r.line)-1]
+				// drop the whole utf-8 character
+				if last&0xc0 != 0x80 {
+					break
+				}
+			}
+		case 0x03, 0x15: // Ctrl-C, Ctrl-U
+			r.line = r.line[:0]
+		case 0x1b:
+			r.escape = 1
+		default:
+			if b >= 0x20 && len(r.line) < maxRecordedLine {
+				r.line = append(r.line, b)
+			}
+		}
+	}
+}
+
+// sftp requests naming the files they act on (draft-ietf-secsh-filexfer-02).
+const (
+	sftpOpen    = 3
+	sftpRemove  = 13
+	sftpMkdir   = 14
+	sftpRmdir   = 15
+	sftpRename  = 18
+	sftpSymlink = 20
+)
+
+// SSH_FXF_WRITE of the pflags of an open.
+const sftpOpenWrite = 0x02
+
+type sftpPathMsg struct {
+	ID   uint32
+	Path string
+	Rest []byte `ssh:"rest"`
+}
+
+type sftpOpenMsg struct {
+	ID    uint32
+	Path  string
+	Flags uint32
+	Rest  []byte `ssh:"rest"`
+}
+
+type sftpTwoPathsMsg struct {
+	ID   uint32
+	From string
+	To   string
+	Rest []byte `ssh:"rest"`
+}
+
+// sftpData splits the client side of an sftp session into packets and logs
+// the ones touching files.
+func (r *sessionRecorder) sftpData(p []byte) {
+	r.sftp = append(r.sftp, p...)
+
+	for len(r.sftp) >= 4 {
+		length := binary.BigEndian.Uint32(r.sftp)
+		if length == 0 || length > maxSFTPPacket {
+			fmt.Fprint(r.logFile, "FileTransfer:sftp stream not understood, no longer followed\n")
+			r.mode = recordExec
+			r.sftp = nil
+			return
+		}
+		if uint32(len(r.sftp)-4) < length {
+			return
+		}
+
+		packet := r.sftp[4 : 4+length]
+		r.sftpPacket(packet[0], packet[1:])
+		r.sftp = r.sftp[4+length:]
+	}
+}
+
+func (r *sessionRecorder) sftpPacket(packetType byte, body []byte) {
+	switch packetType {
+	case sftpOpen:
+		var msg sftpOpenMsg
+		if ssh.Unmarshal(body, &msg) != nil {
+			return
+		}
+		access := "read"
+		if msg.Flags&sftpOpenWrite != 0 {
+			access = "write"
+		}
+		fmt.Fprintf(r.logFile, "FileTransfer:sftp open %q %s\n", msg.Path, access)
+	case sftpRemove, sftpMkdir, sftpRmdir:
+		var msg sftpPathMsg
+		if ssh.Unmarshal(body, &msg) != nil {
+			return
+		}
+		name := map[byte]string{sftpRemove: "remove", sftpMkdir: "mkdir", sftpRmdir: "rmdir"}[packetType]
+		fmt.Fprintf(r.logFile, "FileTransfer:sftp %s %q\n", name, msg.Path)
+	case sftpRename, sftpSymlink:
+		var msg sftpTwoPathsMsg
+		if ssh.Unmarshal(body, &msg) != nil {
+			return
+		}
+		name := "rename"
+		if packetType == sftpSymlink {
+			name = "symlink"
+		}
+		fmt.Fprintf(r.logFile, "FileTransfer:sftp %s %q %q\n", name, msg.From, msg.To)
+	}
+}
+
+// scpStream follows the sending side of the scp protocol: "C0644 <size>
+// <name>" and "D0755 0 <name>" headers, each file being followed by its
+// content and a NUL.
+type scpStream struct {
+	header []byte
+	skip   int64
+}
+
+func (s *scpStream) feed(p []byte, direction string, logFile *os.File) {
+	for len(p) > 0 {
+		if s.skip > 0 {
+			n := int64(len(p))
+			if n > s.skip {
+				n = s.skip
+			}
+			s.skip -= n
+			p = p[n:]
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if len(s.header)+len(p) <= maxRecordedLine {
+				s.header = append(s.header, p...)
+			}
+			return
+		}
+		if len(s.header)+i <= maxRecordedLine {
+			s.header = append(s.header, p[:i]...)
+		}
+		p = p[i+1:]
+
+		s.line(string(s.header), direction, logFile)
+		s.header = s.header[:0]
+	}
+}
+
+func (s *scpStream) line(header string, direction string, logFile *os.File) {
+	// a NUL left over from the content of the previous file
+	header = strings.TrimLeft(header, "\x00")
+	if header == "" {
+		return
+	}
+
+	fields := strings.SplitN(header[1:], " ", 3)
+	switch header[0] {
+	case 'C':
+		if len(fields) != 3 {
+			return
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return
+		}
+		fmt.Fprintf(logFile, "FileTransfer:%s %q (%d bytes, mode %s)\n", direction, fields[2], size, fields[0])
+		// the content and the NUL closing it
+		s.skip = size + 1
+	case 'D':
+		if len(fields) == 3 {
+			fmt.Fprintf(logFile, "FileTransfer:%s directory %q\n", direction, fields[2])
+		}
+	}
+}
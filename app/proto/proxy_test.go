@@ -0,0 +1,317 @@
+package proto
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// startTestBackend runs an in-process ssh server taking root/pw, whose
+// sessions run "cat", "fail" (exit status 3) and an echoing shell.
+func startTestBackend(t *testing.T) net.Listener {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "root" && string(pass) == "pw" {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(testSigner(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(c, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					if nc.ChannelType() != "session" {
+						nc.Reject(ssh.UnknownChannelType, "no")
+						continue
+					}
+					ch, chReqs, err := nc.Accept()
+					if err != nil {
+						continue
+					}
+					go serveTestBackendSession(ch, chReqs)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func serveTestBackendSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	exit := func(status uint32) {
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		ch.Close()
+	}
+
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var msg execMsg
+			ssh.Unmarshal(req.Payload, &msg)
+			req.Reply(true, nil)
+			go func() {
+				switch msg.Command {
+				case "cat":
+					io.Copy(ch, ch)
+					exit(0)
+				case "fail":
+					io.WriteString(ch.Stderr(), "boom\n")
+					exit(3)
+				default:
+					exit(127)
+				}
+			}()
+		case "shell":
+			req.Reply(true, nil)
+			go func() {
+				br := bufio.NewReader(ch)
+				for {
+					line, err := br.ReadString('\r')
+					if err != nil {
+						break
+					}
+					io.WriteString(ch, line+"\n")
+					if line == "exit\r" {
+						break
+					}
+				}
+				exit(0)
+			}()
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+type testProxy struct {
+	client  *ssh.Client
+	done    chan bool
+	logPath string
+}
+
+// startTestProxy accepts one client as root/pw and runs proxySession on it.
+func startTestProxy(t *testing.T, pool *backendPool, dir string) *testProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	logFile, err := os.Create(filepath.Join(dir, "session.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commandList, err := os.Create(filepath.Join(dir, "commands.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := &connAuth{}
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			auth.password = string(pass)
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(testSigner(t))
+
+	p := &testProxy{done: make(chan bool, 1), logPath: logFile.Name()}
+	go func() {
+		defer logFile.Close()
+		defer commandList.Close()
+
+		c, err := l.Accept()
+		if err != nil {
+			p.done <- false
+			return
+		}
+		sshConn, chans, reqs, err := ssh.NewServerConn(c, serverConfig)
+		if err != nil {
+			p.done <- false
+			return
+		}
+		ok := proxySession(pool, sshConn, chans, reqs, auth, DefaultConfig(), logFile, commandList)
+		if !ok {
+			sshConn.Close()
+		}
+		p.done <- ok
+	}()
+
+	p.client, err = ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.Password("pw")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// wait closes the client and returns what proxySession returned.
+func (p *testProxy) wait(t *testing.T) bool {
+	p.client.Close()
+	select {
+	case ok := <-p.done:
+		return ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxySession did not return")
+	}
+	return false
+}
+
+func TestProxySession(t *testing.T) {
+	backend := startTestBackend(t)
+	defer backend.Close()
+
+	dir := testDir(t)
+
+	pool := newBackendPool(BackendList{{Addr: backend.Addr().String()}})
+	p := startTestProxy(t, pool, dir)
+
+	// exec, data both ways
+	session, err := p.client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Stdin = strings.NewReader("hello backend")
+	out, err := session.Output("cat")
+	if err != nil {
+		t.Fatalf("cat: %v", err)
+	}
+	if string(out) != "hello backend" {
+		t.Errorf("cat output %q", out)
+	}
+
+	// exec, stderr and exit status
+	session, err = p.client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	session.Stderr = &stderr
+	err = session.Run("fail")
+	exitErr, ok := err.(*ssh.ExitError)
+	if !ok || exitErr.ExitStatus() != 3 {
+		t.Errorf("fail: got %v, want exit status 3", err)
+	}
+	if stderr.String() != "boom\n" {
+		t.Errorf("fail stderr %q", stderr.String())
+	}
+
+	// shell, keystrokes recorded
+	session, err = p.client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stdin, "ls -la\r")
+	io.WriteString(stdin, "exit\r")
+	echoed, _ := ioutil.ReadAll(stdout)
+	if string(echoed) != "ls -la\r\nexit\r\n" {
+		t.Errorf("shell output %q", echoed)
+	}
+	if err := session.Wait(); err != nil {
+		t.Errorf("shell: %v", err)
+	}
+
+	if !p.wait(t) {
+		t.Fatal("proxySession fell back to emulation")
+	}
+
+	// the backend is back in the pool
+	if _, ok := pool.acquire(); !ok {
+		t.Error("backend not released")
+	}
+
+	logData, err := ioutil.ReadFile(p.logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Backend:" + backend.Addr().String() + "\n",
+		"$ cat\n",
+		"$ fail\n",
+		"$ ls -la\n",
+		"$ exit\n",
+		`ProxyRequest:<-- "exit-status" 00000003 ok=`,
+		"Artifact:proxy-session ",
+	} {
+		if !strings.Contains(string(logData), want) {
+			t.Errorf("session log lacks %q:\n%s", want, logData)
+		}
+	}
+}
+
+func TestProxySessionPoolExhausted(t *testing.T) {
+	dir := testDir(t)
+
+	pool := newBackendPool(BackendList{{Addr: "127.0.0.1:1"}})
+	b, ok := pool.acquire()
+	if !ok {
+		t.Fatal("acquire from a full pool failed")
+	}
+	if _, ok := pool.acquire(); ok {
+		t.Fatal("acquire from an exhausted pool succeeded")
+	}
+
+	// no backend free: the session is left to the emulation
+	p := startTestProxy(t, pool, dir)
+	if p.wait(t) {
+		t.Error("proxySession relayed without a backend")
+	}
+
+	pool.release(b)
+	if got, ok := pool.acquire(); !ok || got != b {
+		t.Errorf("acquire after release = %v, %t", got, ok)
+	}
+}
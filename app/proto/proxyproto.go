@@ -0,0 +1,230 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether connections start with a PROXY protocol header, as sent by
+// HAProxy and most L4 load balancers in front of the listeners.
+const (
+	ProxyProtocolOff      = "off"      // never, the peer is the client
+	ProxyProtocolOptional = "optional" // when they do, the header is used
+	ProxyProtocolRequired = "required" // always, the others are dropped
+)
+
+// ProxyProtocolMode is one of the ProxyProtocol constants, usable as a flag.
+type ProxyProtocolMode string
+
+func (m *ProxyProtocolMode) String() string {
+	if m == nil {
+		return ""
+	}
+	return string(*m)
+}
+
+func (m *ProxyProtocolMode) Set(value string) error {
+	switch value {
+	case ProxyProtocolOff, ProxyProtocolOptional, ProxyProtocolRequired:
+		*m = ProxyProtocolMode(value)
+		return nil
+	}
+	return fmt.Errorf("unknown proxy protocol mode %q", value)
+}
+
+// How long an optional header is waited for, the first byte from the client
+// ending the wait. ssh clients speak first and only the scanners that do
+// not are delayed. Telnet clients wait for the server, and a proxy sends
+// its header as soon as it is connected, so the greeting is only held for
+// about the round trip to it.
+const (
+	proxyHeaderWait       = time.Second
+	telnetProxyHeaderWait = 50 * time.Millisecond
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// longest v1 header, CRLF included.
+const maxProxyV1Header = 107
+
+// proxiedConn is a connection relayed by a proxy: RemoteAddr is the client
+// the proxy reported, proxy the address the connection came from.
+type proxiedConn struct {
+	net.Conn
+	source net.Addr
+	proxy  net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.source
+}
+
+// proxyAddrOf returns the address of the proxy conn was relayed by, or "".
+func proxyAddrOf(conn net.Conn) string {
+	if c, ok := conn.(*proxiedConn); ok {
+		return c.proxy.String()
+	}
+	return ""
+}
+
+// acceptProxyHeader reads the PROXY header the configuration asks for and
+// returns a conn whose RemoteAddr is the client's, or conn itself when
+// there is no header to read. An optional header is waited for that long.
+func acceptProxyHeader(conn net.Conn, conf *Config, wait time.Duration) (net.Conn, error) {
+	mode := string(conf.ProxyProtocol)
+	if mode == "" || mode == ProxyProtocolOff {
+		return conn, nil
+	}
+
+	if len(conf.ProxyProtocolFrom) > 0 {
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !conf.ProxyProtocolFrom.contains(addr.IP) {
+			// anybody else could claim to be anyone
+			if mode == ProxyProtocolRequired {
+				return nil, errors.New("not from a trusted proxy")
+			}
+			return conn, nil
+		}
+	}
+
+	if mode == ProxyProtocolRequired {
+		wait = conf.HandshakeTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// the first byte tells whether a header follows, which then comes whole
+	first := make([]byte, 1)
+	n, err := conn.Read(first)
+	if n == 0 || (first[0] != proxyV1Prefix[0] && first[0] != proxyV2Signature[0]) {
+		if mode == ProxyProtocolRequired {
+			return nil, errors.New("no PROXY header")
+		}
+		if n == 0 {
+			// the client waits for us, or is gone and the next read says so
+			return conn, nil
+		}
+		return &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(first), conn)}, nil
+	}
+
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader(first), conn))
+	buffered := &bufferedConn{Conn: conn, r: br}
+
+	var source net.Addr
+	switch {
+	case hasPrefix(br, proxyV1Prefix):
+		source, err = readProxyV1(br)
+	case hasPrefix(br, proxyV2Signature):
+		source, err = readProxyV2(br)
+	default:
+		if mode == ProxyProtocolRequired {
+			return nil, errors.New("no PROXY header")
+		}
+		return buffered, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if source == nil {
+		// a health check of the proxy itself, or a protocol it cannot relay
+		return buffered, nil
+	}
+	return &proxiedConn{Conn: buffered, source: source, proxy: conn.RemoteAddr()}, nil
+}
+
+// hasPrefix tells whether the next bytes of br are prefix, reading no more
+// of them than needed to tell.
+func hasPrefix(br *bufio.Reader, prefix []byte) bool {
+	for n := 1; n <= len(prefix); n++ {
+		b, err := br.Peek(n)
+		if !bytes.Equal(b, prefix[:len(b)]) {
+			return false
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n". The
+// source is nil for "PROXY UNKNOWN".
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxProxyV1Header {
+			return nil, errors.New("PROXY v1 header too long")
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary header. The source is nil for LOCAL
+// connections and for families other than TCP over IPv4 and IPv6.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown PROXY v2 version %d", header[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,251 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		source  string // "" for no source
+		wantErr bool
+	}{
+		{"tcp4", "PROXY TCP4 192.0.2.1 198.51.100.2 40000 2222\r\n", "192.0.2.1:40000", false},
+		{"tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 40000 2222\r\n", "[2001:db8::1]:40000", false},
+		{"unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"unknown with addresses", "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", "", false},
+		{"truncated", "PROXY TCP4 192.0.2.1 198.51", "", true},
+		{"oversized", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", true},
+		{"bad protocol", "PROXY UDP4 192.0.2.1 198.51.100.2 40000 2222\r\n", "", true},
+		{"bad address", "PROXY TCP4 192.0.2.x 198.51.100.2 40000 2222\r\n", "", true},
+		{"bad port", "PROXY TCP4 192.0.2.1 198.51.100.2 70000 2222\r\n", "", true},
+		{"missing fields", "PROXY TCP4 192.0.2.1\r\n", "", true},
+		{"garbage", "PROXY \x00\xff\xfe\r\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := readProxyV1(bufio.NewReader(strings.NewReader(tt.header)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := ""
+			if source != nil {
+				got = source.String()
+			}
+			if got != tt.source {
+				t.Errorf("source %q, want %q", got, tt.source)
+			}
+		})
+	}
+}
+
+// proxyV2Header builds a v2 header of version/command verCmd and family fam.
+func proxyV2Header(verCmd byte, fam byte, body []byte) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, verCmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(h[14:16], uint16(len(body)))
+	return append(h, body...)
+}
+
+func TestReadProxyV2(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0x9c, 0x40, 0x08, 0xae}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x9c, 0x40, 0x08, 0xae)
+	// TLVs after the addresses are skipped
+	v4TLV := append(append([]byte{}, v4...), 0x04, 0x00, 0x01, 0x00)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		source  string
+		wantErr bool
+	}{
+		{"proxy tcp4", proxyV2Header(0x21, 0x11, v4), "192.0.2.1:40000", false},
+		{"proxy tcp6", proxyV2Header(0x21, 0x21, v6), "[2001:db8::1]:40000", false},
+		{"proxy tcp4 with tlv", proxyV2Header(0x21, 0x11, v4TLV), "192.0.2.1:40000", false},
+		{"local", proxyV2Header(0x20, 0x00, nil), "", false},
+		{"local with addresses", proxyV2Header(0x20, 0x11, v4), "", false},
+		{"udp", proxyV2Header(0x21, 0x12, v4), "", false},
+		{"unix", proxyV2Header(0x21, 0x31, make([]byte, 216)), "", false},
+		{"truncated header", proxyV2Header(0x21, 0x11, v4)[:14], "", true},
+		{"truncated body", proxyV2Header(0x21, 0x11, v4)[:20], "", true},
+		{"short tcp4", proxyV2Header(0x21, 0x11, v4[:4]), "", true},
+		{"short tcp6", proxyV2Header(0x21, 0x21, v6[:20]), "", true},
+		{"bad version", proxyV2Header(0x11, 0x11, v4), "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := readProxyV2(bufio.NewReader(bytes.NewReader(tt.header)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := ""
+			if source != nil {
+				got = source.String()
+			}
+			if got != tt.source {
+				t.Errorf("source %q, want %q", got, tt.source)
+			}
+		})
+	}
+}
+
+// acceptWith sends data over a loopback connection and runs
+// acceptProxyHeader on the server end. It returns the resulting conn, if
+// any, and what is left to read from it.
+func acceptWith(t *testing.T, conf *Config, data []byte) (net.Conn, string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(data)
+	client.(*net.TCPConn).CloseWrite()
+
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := acceptProxyHeader(server, conf, proxyHeaderWait)
+	if err != nil {
+		return nil, "", err
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	rest, _ := ioutil.ReadAll(conn)
+	return conn, string(rest), nil
+}
+
+func TestAcceptProxyHeader(t *testing.T) {
+	header := []byte("PROXY TCP4 192.0.2.1 198.51.100.2 40000 2222\r\nSSH-2.0-client\r\n")
+
+	trusted := CIDRList{}
+	trusted.Set("127.0.0.0/8")
+	untrusted := CIDRList{}
+	untrusted.Set("10.0.0.0/8")
+
+	tests := []struct {
+		name    string
+		mode    ProxyProtocolMode
+		from    CIDRList
+		data    []byte
+		remote  string // "" for the loopback peer
+		rest    string
+		wantErr bool
+	}{
+		{"off", ProxyProtocolOff, nil, header, "", string(header), false},
+		{"optional with header", ProxyProtocolOptional, nil, header, "192.0.2.1:40000", "SSH-2.0-client\r\n", false},
+		{"optional without header", ProxyProtocolOptional, nil, []byte("SSH-2.0-client\r\n"), "", "SSH-2.0-client\r\n", false},
+		{"required with header", ProxyProtocolRequired, nil, header, "192.0.2.1:40000", "SSH-2.0-client\r\n", false},
+		{"required without header", ProxyProtocolRequired, nil, []byte("SSH-2.0-client\r\n"), "", "", true},
+		{"required garbage header", ProxyProtocolRequired, nil, []byte("PROXY nonsense\r\n"), "", "", true},
+		{"trusted source", ProxyProtocolRequired, trusted, header, "192.0.2.1:40000", "SSH-2.0-client\r\n", false},
+		// an untrusted peer's header is not believed, nor consumed
+		{"untrusted source optional", ProxyProtocolOptional, untrusted, header, "", string(header), false},
+		{"untrusted source required", ProxyProtocolRequired, untrusted, header, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DefaultConfig()
+			conf.ProxyProtocol = tt.mode
+			conf.ProxyProtocolFrom = tt.from
+			conf.HandshakeTimeout = time.Second
+
+			conn, rest, err := acceptWith(t, conf, tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if tt.remote != "" {
+				if got := conn.RemoteAddr().String(); got != tt.remote {
+					t.Errorf("remote %q, want %q", got, tt.remote)
+				}
+				if proxyAddrOf(conn) == "" {
+					t.Error("proxy address not kept")
+				}
+			} else if proxyAddrOf(conn) != "" {
+				t.Errorf("connection taken as proxied from %s", conn.RemoteAddr())
+			}
+			if rest != tt.rest {
+				t.Errorf("left %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestOptionalProxyHeaderWait(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ProxyProtocol = ProxyProtocolOptional
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, speaksFirst := range []bool{true, false} {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if speaksFirst {
+			client.Write([]byte("SSH-2.0-client\r\n"))
+		}
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		// a client speaking first ends the wait, a silent one waits it out
+		wait := time.Hour
+		if !speaksFirst {
+			wait = telnetProxyHeaderWait
+		}
+		start := time.Now()
+		conn, err := acceptProxyHeader(server, conf, wait)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("client speaking first %t waited %s", speaksFirst, elapsed)
+		}
+
+		// the end of the wait is not taken for a timeout of the session
+		if !speaksFirst {
+			go client.Write([]byte("\xff\xfb\x18"))
+		}
+		buf := make([]byte, 3)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Errorf("client speaking first %t: read %v", speaksFirst, err)
+		}
+	}
+}
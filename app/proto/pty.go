@@ -0,0 +1,194 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// names of the encoded terminal modes of a pty-req (RFC 4254 section 8).
+var ptyModeNames = map[byte]string{
+	1:   "VINTR",
+	2:   "VQUIT",
+	3:   "VERASE",
+	4:   "VKILL",
+	5:   "VEOF",
+	6:   "VEOL",
+	7:   "VEOL2",
+	8:   "VSTART",
+	9:   "VSTOP",
+	10:  "VSUSP",
+	11:  "VDSUSP",
+	12:  "VREPRINT",
+	13:  "VWERASE",
+	14:  "VLNEXT",
+	15:  "VFLUSH",
+	16:  "VSWTCH",
+	17:  "VSTATUS",
+	18:  "VDISCARD",
+	30:  "IGNPAR",
+	31:  "PARMRK",
+	32:  "INPCK",
+	33:  "ISTRIP",
+	34:  "INLCR",
+	35:  "IGNCR",
+	36:  "ICRNL",
+	37:  "IUCLC",
+	38:  "IXON",
+	39:  "IXANY",
+	40:  "IXOFF",
+	41:  "IMAXBEL",
+	42:  "IUTF8",
+	50:  "ISIG",
+	51:  "ICANON",
+	52:  "XCASE",
+	53:  "ECHO",
+	54:  "ECHOE",
+	55:  "ECHOK",
+	56:  "ECHONL",
+	57:  "NOFLSH",
+	58:  "TOSTOP",
+	59:  "IEXTEN",
+	60:  "ECHOCTL",
+	61:  "ECHOKE",
+	62:  "PENDIN",
+	70:  "OPOST",
+	71:  "OLCUC",
+	72:  "ONLCR",
+	73:  "OCRNL",
+	74:  "ONOCR",
+	75:  "ONLRET",
+	90:  "CS7",
+	91:  "CS8",
+	92:  "PARENB",
+	93:  "PARODD",
+	128: "TTY_OP_ISPEED",
+	129: "TTY_OP_OSPEED",
+}
+
+// parsePtyModes decodes the opcode/uint32 pairs of a pty-req modelist into
+// "NAME=value" strings, stopping at TTY_OP_END or at the first malformed entry.
+func parsePtyModes(modelist string) []string {
+	modes := []string{}
+	decodePtyModes(modelist, func(name string, value uint32) {
+		modes = append(modes, fmt.Sprintf("%s=%d", name, value))
+	})
+	return modes
+}
+
+func decodePtyModes(modelist string, f func(name string, value uint32)) {
+	b := []byte(modelist)
+
+	for len(b) > 0 {
+		opcode := b[0]
+		// TTY_OP_END, or opcodes 160-255 whose arguments are undefined
+		if opcode == 0 || opcode >= 160 || len(b) < 5 {
+			break
+		}
+
+		name, ok := ptyModeNames[opcode]
+		if !ok {
+			name = fmt.Sprintf("OP%d", opcode)
+		}
+		f(name, binary.BigEndian.Uint32(b[1:5]))
+		b = b[5:]
+	}
+}
+
+// ptyInput is the input of a pty going through the line discipline.
+// term.Terminal only ends a line on CR while a tty ends it on NL, which
+// "ssh -tt" from a script or paramiko's invoke_shell send: NL becomes CR,
+// and CR stays one as ICRNL would turn it into NL, or is dropped with
+// IGNCR or without ICRNL, when the tty would keep it within the line.
+type ptyInput struct {
+	r        io.Reader
+	ignoreCR bool
+}
+
+func (p *ptyInput) Read(b []byte) (int, error) {
+	for {
+		n, err := p.r.Read(b)
+		out := b[:0]
+		for _, c := range b[:n] {
+			switch {
+			case c == '\n':
+				out = append(out, '\r')
+			case c == '\r' && p.ignoreCR:
+			default:
+				out = append(out, c)
+			}
+		}
+		// a read of nothing but dropped CRs is not an end of stream
+		if len(out) > 0 || err != nil {
+			return len(out), err
+		}
+	}
+}
+
+// sessionPty is the pseudo terminal a client asked for with pty-req. The
+// shell goroutine owns the terminal while the request loop resizes it.
+type sessionPty struct {
+	mu       sync.Mutex
+	request  ptyRequestMsg
+	terminal *term.Terminal
+	// the decoded modes, ICRNL set and IGNCR clear when the client sent none
+	modes map[string]uint32
+}
+
+func newSessionPty(request ptyRequestMsg) *sessionPty {
+	modes := map[string]uint32{"ICRNL": 1, "IGNCR": 0}
+	decodePtyModes(request.Modelist, func(name string, value uint32) {
+		modes[name] = value
+	})
+
+	return &sessionPty{
+		request: request,
+		modes:   modes,
+	}
+}
+
+// input translates r, what the client types, as the line discipline would.
+func (p *sessionPty) input(r io.Reader) io.Reader {
+	return &ptyInput{
+		r:        r,
+		ignoreCR: p.modes["IGNCR"] != 0 || p.modes["ICRNL"] == 0,
+	}
+}
+
+// attach sizes t to the dimensions reported so far and keeps it for later window changes.
+func (p *sessionPty) attach(t *term.Terminal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.terminal = t
+	p.setSize()
+}
+
+func (p *sessionPty) resize(columns uint32, rows uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.request.Columns = columns
+	p.request.Rows = rows
+	p.setSize()
+}
+
+// setTerm records the terminal type reported after the request, by telnet clients.
+func (p *sessionPty) setTerm(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.request.Term = name
+}
+
+func (p *sessionPty) setSize() {
+	// a zero size means the client only sent pixel dimensions, keep the default then
+	if p.terminal == nil || p.request.Columns == 0 || p.request.Rows == 0 {
+		return
+	}
+
+	p.terminal.SetSize(int(p.request.Columns), int(p.request.Rows))
+}
@@ -1,16 +1,16 @@
 package proto
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -27,258 +27,541 @@ const (
 	Debian      = "Debian"
 )
 
-func StartSshSerer() {
-	password := ""
+// connAuth is what a client did before its connection was established.
+type connAuth struct {
+	password    string
+	method      string
+	bannerShown bool
+}
+
+// newServerConfig builds the ssh configuration of one connection: the version,
+// algorithms, banner and host keys depend on its persona and the captured
+// credentials belong to its client. authStarted is called once the key
+// exchange is over and the client starts authenticating.
+func newServerConfig(kernelInfo string, hostKeys []ssh.Signer, auth *connAuth, authStarted func()) *ssh.ServerConfig {
+	profile := sshProfiles[kernelInfo]
 
 	serverConfig := &ssh.ServerConfig{
 		// NoClientAuth: true,
 		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			password = string(pass)
+			auth.password = string(pass)
+			auth.method = "password"
+			return nil, nil
+		},
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			instruction := renderPersonaTemplate(personaKeyboardInteractive[kernelInfo], kernelInfo, c)
+			answers, err := client("", instruction, []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) == 1 {
+				auth.password = answers[0]
+			}
+			auth.method = "keyboard-interactive"
 			return nil, nil
 		},
-		ServerVersion: "SSH-2.0-OpenSSH_7.2p2 Ubuntu-4",
+		// called on the first authentication request, whether or not a banner is sent
+		BannerCallback: func(c ssh.ConnMetadata) string {
+			authStarted()
+			banner := renderBanner(kernelInfo, c)
+			auth.bannerShown = banner != ""
+			return banner
+		},
+		ServerVersion: profile.version,
 	}
 
-	serverConfig.Ciphers = []string{
-		"aes128-cbc",
-		"blowfish-cbc",
-		"3des-cbc",
-		"aes128-gcm@openssh.com",
-		"chacha20-poly1305@openssh.com",
-		"aes128-ctr",
-		"aes192-ctr",
-		"aes256-ctr",
+	serverConfig.KeyExchanges = supportedOnly(profile.keyExchanges, supportedKeyExchanges)
+	serverConfig.Ciphers = supportedOnly(profile.ciphers, supportedCiphers)
+	serverConfig.MACs = supportedOnly(profile.macs, supportedMACs)
+
+	// the host key algorithms are announced in the order the keys are added
+	for _, algorithm := range profile.hostKeyAlgorithms {
+		for _, hostKey := range hostKeys {
+			if hostKey.PublicKey().Type() == algorithm {
+				serverConfig.AddHostKey(hostKey)
+			}
+		}
 	}
 
+	return serverConfig
+}
+
+func StartSshSerer(conf *Config) {
+	rand.Seed(time.Now().UnixNano())
+
 	if _, err := os.Stat("./log"); os.IsNotExist(err) {
 		os.Mkdir("./log", 0766)
 	}
 
-	privateKeyBytes, err := ioutil.ReadFile("id_rsa")
-	if err != nil {
-		log.Fatal("failed to load private key (./id_rsa)")
-	}
-
-	privateKey, err := ssh.ParsePrivateKey(privateKeyBytes)
+	hostKeys, err := loadHostKeys(conf.HostKeyDir)
 	if err != nil {
-		log.Fatal("failed to parse private key")
+		log.Fatal("failed to load host keys:", err)
 	}
 
-	serverConfig.AddHostKey(privateKey)
-
-	tcpListener, err := net.Listen("tcp", "0.0.0.0:2222")
+	tcpListener, err := listenAll(conf.SSHAddrs)
 	if err != nil {
-		log.Fatalf("failed to listen on 2222 (%s)", err)
+		log.Fatalf("failed to listen on %s (%s)", conf.SSHAddrs.String(), err)
 	}
 
-	log.Print("listening on 2222 port")
-
-	timeoutSec := 30
+	log.Print("listening on " + conf.SSHAddrs.String())
 
-	log.Print("ssh timeout is ", timeoutSec, "s")
+	log.Print("ssh timeouts are handshake ", conf.HandshakeTimeout, ", auth ", conf.AuthTimeout, ", idle ", conf.IdleTimeout, ", session ", conf.SessionTimeout)
 
 	commandList, err := os.OpenFile("./log/commands.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatal("failed open log file:", err)
 	}
 
+	var pool *backendPool
+	if len(conf.ProxyBackends) > 0 {
+		pool = newBackendPool(conf.ProxyBackends)
+		log.Print("relaying ssh sessions to ", conf.ProxyBackends.String())
+	}
+
 	for {
 
 		tcpConn, err := tcpListener.Accept()
 		if err != nil {
 			log.Println("listener accept failed:", err)
+			// most likely out of file descriptors, give the open connections time to end
+			time.Sleep(100 * time.Millisecond)
 			continue
 		}
 
 		go func() {
+			// counted before the PROXY header, which can take a while to come
+			release, ok := acceptGlobal(tcpConn, "ssh", conf, sshProfiles[personaFor(remoteIPOf(tcpConn), conf)].version+"\r\n")
+			if !ok {
+				return
+			}
+			defer release()
 
-			// TODO: 二重Closeを防ぐ
+			conn, err := acceptProxyHeader(tcpConn, conf, proxyHeaderWait)
+			if err != nil {
+				log.Print("PROXY header from "+tcpConn.RemoteAddr().String()+" rejected:", err.Error()+"\n")
+				tcpConn.Close()
+				return
+			}
+			proxyAddr := proxyAddrOf(conn)
 
-			go func() {
-				time.Sleep(time.Duration(timeoutSec) * time.Second)
-				log.Println("timeout")
-				err = tcpConn.Close()
+			// a busy sshd greets the client and then hangs up on it
+			done, ok := acceptLimited(conn, "ssh", conf, sshProfiles[personaFor(remoteIPOf(conn), conf)].version+"\r\n")
+			if !ok {
+				return
+			}
+			defer done()
+
+			kernelInfo := personaFor(remoteIPOf(conn), conf)
+			reason := tarpitReason(remoteIPOf(conn), conf)
+			versionSent := false
+			if reason == "" && len(conf.TarpitClients) > 0 {
+				// ours goes first, as with any server, the handshake
+				// carrying on from there
+				var version string
+				version, conn, err = exchangeVersions(conn, sshProfiles[kernelInfo].version, conf.HandshakeTimeout)
 				if err != nil {
-					log.Println(err)
+					log.Print("ssh version exchange with "+tcpConn.RemoteAddr().String()+" failed:", err.Error()+"\n")
+					tcpConn.Close()
+					return
 				}
-			}()
-
-			sshConn, sshCh, _, err := ssh.NewServerConn(tcpConn, serverConfig)
-			if err != nil {
-				log.Println("new server connect failed:", err)
-				err = tcpConn.Close()
-				if err != nil {
-					log.Println(err)
+				versionSent = true
+				if conf.TarpitClients.match(version) {
+					reason = fmt.Sprintf("client %q", version)
+				}
+			}
+			// with the tarpit full the client gets the real thing
+			if reason != "" && tarpit(conn, "ssh", reason, conf, func() {
+				// the tarpit has its own limit
+				done()
+				release()
+				if versionSent {
+					conn.Write(sshTarpitPacket)
 				}
+			}) {
 				return
 			}
 
-			utcTime := time.Now().UTC().Format(time.RFC3339Nano)
+			guard := newGuardedConn(conn, conf.SessionTimeout)
+			defer guard.Close()
+
+			guard.setPhase(phaseHandshake, conf.HandshakeTimeout)
 
-			remoteIP := strings.Split(sshConn.RemoteAddr().String(), ":")[0]
+			auth := &connAuth{}
+			serverConfig := newServerConfig(kernelInfo, hostKeys[kernelInfo], auth, func() {
+				guard.setPhase(phaseAuth, conf.AuthTimeout)
+			})
 
-			if _, err := os.Stat(remoteIP); os.IsNotExist(err) {
-				os.Mkdir("./log/"+remoteIP, 0766)
+			sshConn, sshCh, sshGlobalRequest, err := ssh.NewServerConn(guard, serverConfig)
+			if err != nil {
+				log.Println("new server connect failed:", err, "("+guard.closeReason()+")")
+				return
 			}
 
-			logFileName := "./log/" + remoteIP + "/" + utcTime + ".txt"
+			guard.setPhase(phaseSession, conf.IdleTimeout)
 
-			logFile, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE, 0666)
+			now := time.Now()
+			utcTime := now.UTC().Format(time.RFC3339Nano)
+
+			logFile, err := createSessionLog("./log", sshConn.RemoteAddr(), now)
 			if err != nil {
-				log.Fatal("failed open log file:", err)
+				// out of file descriptors or disk space, drop this client and keep serving
+				log.Print("failed open log file:", err.Error()+"\n")
+				return
 			}
+			defer logFile.Close()
 
 			fmt.Fprint(logFile, "RemoteAddr:"+sshConn.RemoteAddr().String()+"\n")
+			if proxyAddr != "" {
+				fmt.Fprint(logFile, "ProxyAddr:"+proxyAddr+"\n")
+			}
 			fmt.Fprint(logFile, "User:"+string(sshConn.User())+"\n")
-			fmt.Fprint(logFile, "Password:"+password+"\n")
+			fmt.Fprint(logFile, "Password:"+auth.password+"\n")
+			fmt.Fprint(logFile, "AuthMethod:"+auth.method+"\n")
+			fmt.Fprintf(logFile, "Banner:%t\n", auth.bannerShown)
 			fmt.Fprint(logFile, "ServerVersion:"+string(sshConn.ServerVersion())+"\n")
 			fmt.Fprint(logFile, "ClientVersion:"+string(sshConn.ClientVersion())+"\n")
 			fmt.Fprint(logFile, "Time:"+utcTime+"\n")
+			fmt.Fprint(logFile, "OS:"+kernelInfo+"\n")
 
-			log.Print("new ssh connection from " + sshConn.RemoteAddr().String() + ", " + string(sshConn.ClientVersion()) + "\n")
-
-			go func() {
-				for c := range sshCh {
-					go func(sshNewChannel ssh.NewChannel) {
-						err := handleChannel(sshNewChannel, logFile, commandList, sshConn.User())
-						if err != nil {
-							log.Print("handle channel error :", err)
-							err = sshConn.Close()
-							if err != nil {
-								log.Println(err)
-							}
-							err = tcpConn.Close()
-							if err != nil {
-								log.Println(err)
-							}
-							return
-						}
-					}(c)
-				}
-			}()
+			if proxyAddr != "" {
+				log.Print("new ssh connection from " + sshConn.RemoteAddr().String() + " via " + proxyAddr + ", " + string(sshConn.ClientVersion()) + "\n")
+			} else {
+				log.Print("new ssh connection from " + sshConn.RemoteAddr().String() + ", " + string(sshConn.ClientVersion()) + "\n")
+			}
+
+			if pool != nil && proxySession(pool, sshConn, sshCh, sshGlobalRequest, auth, conf, logFile, commandList) {
+				fmt.Fprint(logFile, "Disconnect:"+guard.closeReason()+"\n")
+				log.Print("proxied ssh connection from " + sshConn.RemoteAddr().String() + " closed: " + guard.closeReason() + "\n")
+				return
+			}
+
+			serveConn(sshConn, sshCh, sshGlobalRequest, conf, logFile, commandList, kernelInfo)
+			fmt.Fprint(logFile, "Disconnect:"+guard.closeReason()+"\n")
+			log.Print("ssh connection from " + sshConn.RemoteAddr().String() + " closed: " + guard.closeReason() + "\n")
 
 		}()
 
 	}
 }
 
-func handleChannel(sshNewChannel ssh.NewChannel, logFile *os.File, commandList *os.File, userName string) error {
+// serveConn emulates the host for an established connection until it is
+// closed, and returns once nothing writes to logFile any more.
+func serveConn(sshConn *ssh.ServerConn, sshCh <-chan ssh.NewChannel, sshGlobalRequest <-chan *ssh.Request, conf *Config, logFile *os.File, commandList *os.File, kernelInfo string) {
+	// everything writing to logFile is waited for before it is closed
+	var handlers sync.WaitGroup
+	sessions := &sessionLimit{}
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		handleGlobalRequests(sshGlobalRequest, sessions, conf, logFile)
+	}()
+
+	for c := range sshCh {
+		// counted here, in the order the client opened them
+		if c.ChannelType() == "session" && !sessions.open() {
+			fmt.Fprint(logFile, "RejectedChannel:session after NoMoreSessions\n")
+			c.Reject(ssh.Prohibited, "no more sessions")
+			continue
+		}
+		handlers.Add(1)
+		go func(sshNewChannel ssh.NewChannel) {
+			defer handlers.Done()
+			// a failing channel only takes itself down, the
+			// rest of the connection keeps going like with sshd
+			err := handleChannel(sshNewChannel, conf, logFile, commandList, sshConn.User(), kernelInfo)
+			if err != nil {
+				log.Print("handle channel error :", err)
+			}
+		}(c)
+	}
+
+	// the channels are closed along with the connection
+	sshConn.Wait()
+	handlers.Wait()
+}
+
+func handleChannel(sshNewChannel ssh.NewChannel, conf *Config, logFile *os.File, commandList *os.File, userName string, kernelInfo string) error {
 
 	channelType := sshNewChannel.ChannelType()
 
 	switch channelType {
 	case "direct-tcpip": // ssh fowarding
-		errMsg := fmt.Sprintf("forbidden channel type: %s", channelType)
-		log.Print(errMsg + "\n")
+		return handleDirectTcpip(sshNewChannel, conf, logFile)
+	case "session":
+		return handleSession(sshNewChannel, logFile, commandList, userName, kernelInfo)
+	case "forwarded-tcpip", "x11", "auth-agent@openssh.com", "tun@openssh.com":
+		// these are only ever opened by the server side, or need a
+		// feature sshd has disabled here
+		fmt.Fprintf(logFile, "RejectedChannel:%s %x\n", channelType, sshNewChannel.ExtraData())
+
+		var msg directTcpipMsg
+		if channelType == "forwarded-tcpip" && ssh.Unmarshal(sshNewChannel.ExtraData(), &msg) == nil {
+			fmt.Fprintf(logFile, "ForwardedTcpip:%s:%d from %s:%d\n", msg.DestAddr, msg.DestPort, msg.OrigAddr, msg.OrigPort)
+		}
 
-		sshChannel, _, err := sshNewChannel.Accept()
+		err := sshNewChannel.Reject(ssh.Prohibited, "open failed")
 		if err != nil {
-			errMsg := fmt.Sprintf("connection failed: because of %s", err.Error())
-			log.Print(errMsg + "\n")
-			err := sshNewChannel.Reject(ssh.ConnectionFailed, errMsg)
-			if err != nil {
-				log.Print("reject Failed:", err.Error()+"\n")
-				return err
-			}
-			return nil
+			log.Print("reject failed:", err.Error()+"\n")
+			return err
 		}
+		return nil
+	default:
+		errMsg := fmt.Sprintf("unknown channel type: %s", channelType)
+		log.Print(errMsg + "\n")
+		fmt.Fprintf(logFile, "UnknownChannel:%q %x\n", channelType, sshNewChannel.ExtraData())
 
-		defer sshChannel.Close()
-
-		_, err = sshChannel.Write([]byte(" "))
+		err := sshNewChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 		if err != nil {
-			errMsg := fmt.Sprintf("write data failed: because of %s", err.Error())
-			log.Print(errMsg + "\n")
-			err := sshNewChannel.Reject(ssh.ConnectionFailed, errMsg)
-			if err != nil {
-				log.Print("reject Failed:", err.Error()+"\n")
-				return err
-			}
-			return nil
+			log.Print("reject failed:", err.Error()+"\n")
+			return err
 		}
-
 		return nil
-	case "session":
-		sshChannel, sshRequest, err := sshNewChannel.Accept()
+	}
+}
+
+func handleSession(sshNewChannel ssh.NewChannel, logFile *os.File, commandList *os.File, userName string, kernelInfo string) error {
+	sshChannel, sshRequest, err := sshNewChannel.Accept()
+	if err != nil {
+		errMsg := fmt.Sprintf("connection failed: because of %s", err.Error())
+		log.Print(errMsg + "\n")
+		err := sshNewChannel.Reject(ssh.ConnectionFailed, errMsg)
 		if err != nil {
-			errMsg := fmt.Sprintf("connection failed: because of %s", err.Error())
-			log.Print(errMsg + "\n")
-			err := sshNewChannel.Reject(ssh.ConnectionFailed, errMsg)
-			if err != nil {
-				log.Print("reject Failed:", err.Error()+"\n")
-				return err
-			}
-			return nil
+			log.Print("reject Failed:", err.Error()+"\n")
+			return err
 		}
+		return nil
+	}
 
-		defer sshChannel.Close()
-
-		kernelVersions := []string{Ubuntu, KaliLinux, RaspberryPi, AmazonLinux, CentOS, Debian}
-
-		rand.Seed(time.Now().UnixNano())
-
-		kernelInfo := kernelVersions[rand.Intn(len(kernelVersions))]
-
-		fmt.Fprint(logFile, "OS:"+kernelInfo+"\n")
-
-		for c := range sshRequest {
-			if c.Type == "shell" {
-				fmt.Fprint(logFile, "RequestTyped:Shell"+"\n-----\n")
+	defer sshChannel.Close()
 
-				err := handleShell(sshChannel, logFile, commandList, userName, kernelInfo)
+	// shell and exec run in their own goroutine so that window-change and
+	// signal requests are still serviced while the command is running.
+	done := make(chan processResult, 1)
+	proc := newProcessChannel(sshChannel)
+	defer proc.kill()
+	started := false
+	interactive := false
+	var pty *sessionPty
 
-				if err != nil {
-					log.Print("handle shell error:", err.Error()+"\n")
-					return err
+	for {
+		select {
+		case result := <-done:
+			if result.err != nil {
+				return result.err
+			}
+			return sendExit(sshChannel, result.info, logFile)
+		case c, ok := <-sshRequest:
+			if !ok {
+				if started {
+					result := <-done
+					return result.err
 				}
-
 				return nil
+			}
 
-			} else if c.Type == "env" {
-
-			} else if c.Type == "pty-req" {
+			switch c.Type {
+			case "pty-req":
+				var msg ptyRequestMsg
+				if err := ssh.Unmarshal(c.Payload, &msg); err != nil {
+					log.Print("malformed pty-req payload:", err.Error()+"\n")
+					c.Reply(false, nil)
+					continue
+				}
+				if started {
+					c.Reply(false, nil)
+					continue
+				}
+				fmt.Fprint(logFile, "PtyTerm:"+msg.Term+"\n")
+				fmt.Fprintf(logFile, "PtySize:%dx%d (%dx%d pixels)\n", msg.Columns, msg.Rows, msg.Width, msg.Height)
+				fmt.Fprint(logFile, "PtyModes:"+strings.Join(parsePtyModes(msg.Modelist), " ")+"\n")
+				pty = newSessionPty(msg)
+				c.Reply(true, nil)
+			case "env":
+				var msg envRequestMsg
+				if err := ssh.Unmarshal(c.Payload, &msg); err != nil {
+					log.Print("malformed env payload:", err.Error()+"\n")
+					c.Reply(false, nil)
+					continue
+				}
+				fmt.Fprint(logFile, "Env:"+msg.Name+"="+msg.Value+"\n")
+				// the stock sshd_config only has "AcceptEnv LANG LC_*"
+				c.Reply(msg.Name == "LANG" || strings.HasPrefix(msg.Name, "LC_"), nil)
+			case "shell":
+				if started {
+					c.Reply(false, nil)
+					continue
+				}
+				started = true
+				interactive = true
+				c.Reply(true, nil)
+				fmt.Fprint(logFile, "RequestTyped:Shell"+"\n-----\n")
 
-			} else if c.Type == "exec" {
+				go func() {
+					info, err := handleShell(proc, pty, logFile, commandList, userName, kernelInfo)
+					if err != nil {
+						log.Print("handle shell error:", err.Error()+"\n")
+					}
+					done <- processResult{info: info, err: err}
+				}()
+			case "exec":
+				var msg execMsg
+				if started || ssh.Unmarshal(c.Payload, &msg) != nil {
+					c.Reply(false, nil)
+					continue
+				}
+				started = true
+				c.Reply(true, nil)
 				fmt.Fprint(logFile, "RequestTyped:Exec"+"\n-----\n")
-				err := handleExec(sshChannel, c, logFile, commandList, userName, kernelInfo)
 
-				if err != nil {
-					log.Print("handle exec error:", err.Error()+"\n")
-					return err
+				go func() {
+					info, err := handleExec(proc, pty, msg.Command, logFile, commandList, userName, kernelInfo)
+					if err != nil {
+						log.Print("handle exec error:", err.Error()+"\n")
+					}
+					done <- processResult{info: info, err: err}
+				}()
+			case "subsystem":
+				var msg subsystemRequestMsg
+				if err := ssh.Unmarshal(c.Payload, &msg); err != nil {
+					log.Print("malformed subsystem payload:", err.Error()+"\n")
+					c.Reply(false, nil)
+					continue
+				}
+				fmt.Fprint(logFile, "Subsystem:"+msg.Subsystem+"\n")
+				c.Reply(false, nil)
+			case "window-change":
+				var msg windowChangeMsg
+				if err := ssh.Unmarshal(c.Payload, &msg); err != nil {
+					log.Print("malformed window-change payload:", err.Error()+"\n")
+					continue
 				}
+				fmt.Fprintf(logFile, "WindowChange:%dx%d (%dx%d pixels)\n", msg.Columns, msg.Rows, msg.Width, msg.Height)
+				if pty != nil {
+					pty.resize(msg.Columns, msg.Rows)
+				}
+			case "x11-req":
+				var msg x11RequestMsg
+				if err := ssh.Unmarshal(c.Payload, &msg); err != nil {
+					log.Print("malformed x11-req payload:", err.Error()+"\n")
+					c.Reply(false, nil)
+					continue
+				}
+				fmt.Fprintf(logFile, "X11Request:single=%t protocol=%s cookie=%s screen=%d\n", msg.SingleConnection, msg.AuthProtocol, msg.AuthCookie, msg.ScreenNumber)
+				// X11Forwarding is off in the stock sshd_config of most of the personas
+				c.Reply(false, nil)
+			case "auth-agent-req@openssh.com":
+				fmt.Fprint(logFile, "AgentForwardingRequest\n")
+				c.Reply(false, nil)
+			case "signal":
+				var msg signalMsg
+				if err := ssh.Unmarshal(c.Payload, &msg); err != nil {
+					log.Print("malformed signal payload:", err.Error()+"\n")
+					continue
+				}
+				fmt.Fprint(logFile, "Signal:"+msg.Signal+"\n")
 
-				err = sshChannel.Close()
-				if err != nil {
-					log.Print("channel close failed:", err.Error()+"\n")
-					return err
+				// the emulated process dies unless it is an interactive
+				// shell, which ignores INT, QUIT and TERM like bash does.
+				signal := parseSignal(msg.Signal)
+				if !started || signal == "" || (interactive && interactiveIgnoredSignals[signal]) {
+					continue
 				}
-				return nil
-			} else {
+				// the process is gone before its exit is reported,
+				// nothing of it is written after that
+				proc.kill()
+				<-done
+				return sendExit(sshChannel, exitInfo{status: 128 + signalNumber(signal), signal: signal, exited: true}, logFile)
+			default:
 				log.Print("unknown ssh request type:", c.Type+"\n")
+				fmt.Fprintf(logFile, "UnknownRequest:%q %x\n", c.Type, c.Payload)
+				c.Reply(false, nil)
 			}
 		}
-	default:
-		errMsg := fmt.Sprintf("unknown channel type: %s", channelType)
-		log.Print(errMsg + "\n")
-		err := sshNewChannel.Reject(ssh.UnknownChannelType, errMsg)
-		if err != nil {
-			log.Print("reject failed:", err.Error()+"\n")
-			return err
-		}
-		return errors.New(errMsg)
+	}
+}
+
+func handleShell(c ssh.Channel, pty *sessionPty, logFile *os.File, commandList *os.File, userName string, kernelInfo string) (exitInfo, error) {
+
+	lineLabel := shellPrompt(userName, kernelInfo)
+
+	if pty == nil {
+		return handleRawShell(c, c, lineLabel, logFile, commandList, kernelInfo)
 	}
 
-	errMsg := "unknown channel type"
-	return errors.New(errMsg)
+	term := term.NewTerminal(ReadWriter{pty.input(c), c}, "")
+	pty.attach(term)
+
+	return serveTerminal(term, lineLabel, nil, logFile, commandList, kernelInfo)
+}
+
+// readTerminalLine reads a line from t, echoing it unless echo says not to.
+func readTerminalLine(t *term.Terminal, prompt string, echo func() bool) (string, error) {
+	if echo != nil && !echo() {
+		// the only read of term.Terminal without echo, despite its name
+		return t.ReadPassword(prompt)
+	}
+	return t.ReadLine()
 }
 
-func handleShell(c ssh.Channel, logFile *os.File, commandList *os.File, userName string, kernelInfo string) error {
+// shellPrompt is the prompt of the shell, on ssh and telnet alike.
+func shellPrompt(userName string, kernelInfo string) string {
+	return userName + "@" + kernelInfo + ":~$ "
+}
+
+// serveTerminal runs an interactive login shell on term, for ssh sessions with
+// a pty and for telnet. The lines are read without echo when echo, if not
+// nil, says the other end does its own.
+func serveTerminal(term *term.Terminal, lineLabel string, echo func() bool, logFile *os.File, commandList *os.File, kernelInfo string) (exitInfo, error) {
+	prompt := lineLabel + string(term.Escape.Reset)
+	term.SetPrompt(prompt)
+
+	terminalHeader, err := loginHeader(kernelInfo)
+	if err != nil {
+		return exitInfo{}, err
+	}
+
+	fmt.Fprint(term, terminalHeader)
+	fmt.Fprint(logFile, terminalHeader)
 
-	term := term.NewTerminal(c, "")
-	lineLabel := userName + "@" + kernelInfo + ":~$ "
+	lastStatus := 0
 
-	term.SetPrompt(lineLabel + string(term.Escape.Reset))
+	for {
+		line, err := readTerminalLine(term, prompt, echo)
+		if err == io.EOF {
+			// Ctrl-D on an empty line, or the client closing stdin, ends the login shell
+			log.Print("read eof", "\n")
+			fmt.Fprint(term, "logout\n")
+			return exitInfo{status: lastStatus, exited: true}, nil
+		}
+		if err != nil {
+			log.Print("read line failed:", err.Error()+"\n")
+			return exitInfo{}, err
+		}
+		if line == "" {
+			continue
+		}
 
+		info, ok := emulateBuiltin(line, lastStatus, true, term, logFile, commandList)
+		if !ok {
+			info, err = emulateCommand([]byte(line), lineLabel, kernelInfo, term, logFile, commandList)
+			if err != nil {
+				log.Print(err.Error() + "\n")
+				return exitInfo{}, err
+			}
+		}
+		if info.exited {
+			if info.signal == "" {
+				fmt.Fprint(term, "logout\n")
+			}
+			return info, nil
+		}
+		lastStatus = info.status
+
+	}
+}
+
+// loginHeader is what the persona's sshd and login print before the first prompt.
+func loginHeader(kernelInfo string) (string, error) {
 	var terminalHeader string
 
 	if kernelInfo == Ubuntu {
@@ -302,36 +585,50 @@ func handleShell(c ssh.Channel, logFile *os.File, commandList *os.File, userName
 	} else {
 		errMsg := "unknown kernel info: " + kernelInfo + "\n"
 		log.Print(errMsg)
-		return errors.New(errMsg)
+		return "", errors.New(errMsg)
 	}
 
-	fmt.Fprint(term, terminalHeader)
-	fmt.Fprint(logFile, terminalHeader)
+	return terminalHeader, nil
+}
+
+// handleRawShell serves a shell requested without a pty, as with "ssh -T"
+// or a piped script: no prompt, no banner, no echo and no line editing.
+func handleRawShell(c ssh.Channel, r io.Reader, lineLabel string, logFile *os.File, commandList *os.File, kernelInfo string) (exitInfo, error) {
+	reader := bufio.NewReader(r)
+	lastStatus := 0
 
 	for {
-		line, err := term.ReadLine()
-		if err == io.EOF {
-			log.Print("read eof", "\n")
-			return nil
-		}
-		if err != nil {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
 			log.Print("read line failed:", err.Error()+"\n")
-			return err
-		}
-		if line == "" {
-			continue
+			return exitInfo{}, err
 		}
+		eof := err == io.EOF
 
-		err = emulateCommand([]byte(line), lineLabel, kernelInfo, term, logFile, commandList)
-		if err != nil {
-			log.Print(err.Error() + "\n")
-			return err
+		line = strings.TrimRight(line, "\r\n")
+		if strings.TrimSpace(line) != "" {
+			info, ok := emulateBuiltin(line, lastStatus, false, c.Stderr(), logFile, commandList)
+			if !ok {
+				info, err = emulateCommand([]byte(line), lineLabel, kernelInfo, c, logFile, commandList)
+				if err != nil {
+					log.Print(err.Error() + "\n")
+					return exitInfo{}, err
+				}
+			}
+			if info.exited {
+				return info, nil
+			}
+			lastStatus = info.status
 		}
 
+		if eof {
+			log.Print("read eof", "\n")
+			return exitInfo{status: lastStatus, exited: true}, nil
+		}
 	}
 }
 
-func emulateCommand(v []byte, lineLabel string, kernelInfo string, term *term.Terminal, logFile *os.File, commandList *os.File) error {
+func emulateCommand(v []byte, lineLabel string, kernelInfo string, w io.Writer, logFile *os.File, commandList *os.File) (exitInfo, error) {
 	v = bytes.TrimFunc(v, unicode.IsControl)
 	splitPayload := bytes.Split(v, []byte{32})
 
@@ -346,88 +643,217 @@ func emulateCommand(v []byte, lineLabel string, kernelInfo string, term *term.Te
 			}
 		}
 	}
-	fmt.Println("$", commandName, strings.Join(commandArgs, " "))
-	command := commandName + " "
-
-	for _, v := range commandArgs {
-		command += v
+	logCommand(string(v), logFile, commandList)
+	if commandName == "" {
+		return exitInfo{}, nil
 	}
 
-	fmt.Fprint(logFile, "$ "+string(v)+"\n")
-	fmt.Fprint(commandList, "$ "+string(v)+"\n")
-	msg := command
+	msg := ""
+	status := 0
 	if commandName == "uname" {
-		if len(commandArgs) > 0 {
-			if commandArgs[0] == "-a" {
-				if kernelInfo == Ubuntu {
-					// Ubuntu
-					msg = "Linux ubuntu 4.10.0-35-generic #39~16.04.1-Ubuntu SMP Wed Sep 13 09:02:42 UTC 2017 x86_64 GNU/Linux\n"
-				} else if kernelInfo == KaliLinux {
-					// KaliLinux
-					msg = "Linux kali 4.14.71-v8 #1 SMP PREEMPT Wed Oct 31 21:41:06 UTC 2018 aarch64 GNU/Linux\n"
-				} else if kernelInfo == AmazonLinux {
-					// AmazonLinux
-					msg = "Linux ip-170-31-81-10.ec2.internal 4.10.109-90.92.amzn2.x86_64 #1 SMP Mon Apr 1 23:00:38 UTC 2019 x86_64 x86_64 x86_64 GNU/Linux\n"
-				} else if kernelInfo == RaspberryPi {
-					// RaspberryPi
-					msg = "Linux raspberrypi 3.18.11-v7+ #781 SMP PREEMPT Tue Apr 21 18:07:59 BST 2015 armv7l GNU/Linux\n"
-				} else if kernelInfo == Debian {
-					// Debian
-					msg = "Linux debian 3.2.0-4-amd64 #1 SMP Debian 3.2.65-1+deb7u2 x86_64 GNU/Linux\n"
-				} else if kernelInfo == CentOS {
-					// CentOS
-					msg = "Linux cent 3.10.0-327.28.2.el7.x86_64 #1 SMP Wed Aug 3 11:11:39 UTC 2016 x86_64 x86_64 x86_64 GNU/Linux\n"
-				} else {
-					errMsg := "unknown kernel info: " + kernelInfo + "\n"
-					log.Print(errMsg)
-					return errors.New(errMsg)
-				}
-			}
-		} else {
-			msg = "Linux\n"
+		var err error
+		msg, status, err = emulateUname(commandArgs, kernelInfo)
+		if err != nil {
+			log.Print(err.Error())
+			return exitInfo{}, err
 		}
-		fmt.Fprint(term, msg)
+		fmt.Fprint(w, msg)
 		fmt.Fprint(logFile, msg)
 	} else if commandName == "/ip" {
-		if len(commandArgs) > 0 {
-			if len(commandArgs) == 2 {
-				if commandArgs[0] == "cloud" {
-					if commandArgs[1] == "print" {
-						msg = "         ddns-enabled: yes\n ddns-update-interval: none\n          update-time: yes\n       public-address: 93.184.216.34\n  public-address-ipv6: 2b02:610:7501:2000::2\n             dns-name: 529c0491d41c.sn.example.net\n               status: updated\n"
-					} else {
-						msg = ""
-					}
-				} else {
-					msg = ""
-				}
-			} else {
-				msg = ""
-			}
-		} else {
-			msg = ""
+		msg = ""
+		status = 1
+		if len(commandArgs) == 2 && commandArgs[0] == "cloud" && commandArgs[1] == "print" {
+			msg = "         ddns-enabled: yes\n ddns-update-interval: none\n          update-time: yes\n       public-address: 93.184.216.34\n  public-address-ipv6: 2b02:610:7501:2000::2\n             dns-name: 529c0491d41c.sn.example.net\n               status: updated\n"
+			status = 0
 		}
-		fmt.Fprint(term, msg)
+		fmt.Fprint(w, msg)
 		fmt.Fprint(logFile, msg)
+	} else if commandName == "echo" {
+		msg = strings.Join(commandArgs, " ") + "\n"
+		fmt.Fprint(w, msg)
+		fmt.Fprint(logFile, msg)
+	} else if commandName == "true" {
+	} else if commandName == "false" {
+		status = 1
 	} else {
-		msg = string(v) + "\n"
-		fmt.Fprint(term, msg)
+		// what bash says, a path that does not exist or a name not in $PATH
+		if strings.Contains(commandName, "/") {
+			msg = "bash: " + commandName + ": No such file or directory\n"
+		} else {
+			msg = "bash: " + commandName + ": command not found\n"
+		}
+		status = 127
+		fmt.Fprint(w, msg)
 		fmt.Fprint(logFile, msg)
 	}
 
-	return nil
+	return exitInfo{status: status}, nil
+}
+
+// unameAll is the "uname -a" of each persona.
+var unameAll = map[string]string{
+	Ubuntu:      "Linux ubuntu 4.10.0-35-generic #39~16.04.1-Ubuntu SMP Wed Sep 13 09:02:42 UTC 2017 x86_64 GNU/Linux",
+	KaliLinux:   "Linux kali 4.14.71-v8 #1 SMP PREEMPT Wed Oct 31 21:41:06 UTC 2018 aarch64 GNU/Linux",
+	AmazonLinux: "Linux ip-170-31-81-10.ec2.internal 4.10.109-90.92.amzn2.x86_64 #1 SMP Mon Apr 1 23:00:38 UTC 2019 x86_64 x86_64 x86_64 GNU/Linux",
+	RaspberryPi: "Linux raspberrypi 3.18.11-v7+ #781 SMP PREEMPT Tue Apr 21 18:07:59 BST 2015 armv7l GNU/Linux",
+	Debian:      "Linux debian 3.2.0-4-amd64 #1 SMP Debian 3.2.65-1+deb7u2 x86_64 GNU/Linux",
+	CentOS:      "Linux cent 3.10.0-327.28.2.el7.x86_64 #1 SMP Wed Aug 3 11:11:39 UTC 2016 x86_64 x86_64 x86_64 GNU/Linux",
+}
+
+// emulateUname answers uname with the options -a, -s, -n, -r and -m, the
+// fields of the others being cut out of the -a line.
+func emulateUname(args []string, kernelInfo string) (string, int, error) {
+	all, ok := unameAll[kernelInfo]
+	if !ok {
+		return "", 0, errors.New("unknown kernel info: " + kernelInfo + "\n")
+	}
+	fields := strings.Fields(all)
+
+	if len(args) == 0 {
+		return fields[0] + "\n", 0, nil
+	}
+
+	out := []string{}
+	for _, arg := range args {
+		if arg == "-a" || arg == "--all" {
+			return all + "\n", 0, nil
+		}
+		if !strings.HasPrefix(arg, "-") || len(arg) < 2 {
+			return "uname: extra operand '" + arg + "'\nTry 'uname --help' for more information.\n", 1, nil
+		}
+		for _, option := range arg[1:] {
+			switch option {
+			case 's':
+				out = append(out, fields[0])
+			case 'n':
+				out = append(out, fields[1])
+			case 'r':
+				out = append(out, fields[2])
+			case 'm':
+				// the machine is right before the processor and platform, or the OS
+				out = append(out, fields[len(fields)-2])
+			case 'a':
+				return all + "\n", 0, nil
+			default:
+				return "uname: invalid option -- '" + string(option) + "'\nTry 'uname --help' for more information.\n", 1, nil
+			}
+		}
+	}
+	return strings.Join(out, " ") + "\n", 0, nil
 }
 
-func handleExec(c ssh.Channel, r *ssh.Request, logFile *os.File, commandList *os.File, userName string, kernelInfo string) error {
-	term := term.NewTerminal(c, "")
+func handleExec(c ssh.Channel, pty *sessionPty, command string, logFile *os.File, commandList *os.File, userName string, kernelInfo string) (exitInfo, error) {
+	lineLabel := shellPrompt(userName, kernelInfo)
 
-	lineLabel := userName + "@" + kernelInfo + ":~$ "
+	// without a pty the output goes out untranslated, with one ("ssh -t")
+	// the terminal turns \n into \r\n like the tty's onlcr would.
+	var w io.Writer = c
+	if pty != nil {
+		term := term.NewTerminal(c, "")
+		pty.attach(term)
+		w = term
+	}
+
+	if kind := stdinConsumer(command); kind != "" {
+		fmt.Fprint(logFile, "Stdin:"+kind+"\n")
+		return handleExecStdin(c, kind, command, lineLabel, w, logFile, commandList, kernelInfo)
+	}
 
-	term.SetPrompt(lineLabel + string(term.Escape.Reset))
+	info, ok := emulateBuiltin(command, 0, false, c.Stderr(), logFile, commandList)
+	if ok {
+		return info, nil
+	}
 
-	err := emulateCommand(r.Payload, lineLabel, kernelInfo, term, logFile, commandList)
+	info, err := emulateCommand([]byte(command), lineLabel, kernelInfo, w, logFile, commandList)
 	if err != nil {
 		log.Print(err.Error() + "\n")
-		return err
+		return exitInfo{}, err
+	}
+	return info, nil
+}
+
+// processResult is what the goroutine running a shell or exec request reports.
+type processResult struct {
+	info exitInfo
+	err  error
+}
+
+// processChannel is the channel as the emulated process sees it, which can
+// be killed: its input ends and its output is dropped from then on.
+type processChannel struct {
+	ssh.Channel
+	in     *io.PipeReader
+	killed chan struct{}
+	once   sync.Once
+}
+
+func newProcessChannel(c ssh.Channel) *processChannel {
+	r, w := io.Pipe()
+	go func() {
+		_, err := io.Copy(w, c)
+		w.CloseWithError(err)
+	}()
+	return &processChannel{Channel: c, in: r, killed: make(chan struct{})}
+}
+
+func (p *processChannel) Read(data []byte) (int, error) {
+	return p.in.Read(data)
+}
+
+func (p *processChannel) Write(data []byte) (int, error) {
+	select {
+	case <-p.killed:
+		return 0, io.ErrClosedPipe
+	default:
+		return p.Channel.Write(data)
+	}
+}
+
+func (p *processChannel) Stderr() io.ReadWriter {
+	return &processStderr{p.Channel.Stderr(), p.killed}
+}
+
+// kill ends the input of the process, which then finishes what it was
+// doing without writing to the client any more.
+func (p *processChannel) kill() {
+	p.once.Do(func() {
+		close(p.killed)
+		p.in.CloseWithError(io.EOF)
+	})
+}
+
+type processStderr struct {
+	io.ReadWriter
+	killed chan struct{}
+}
+
+func (p *processStderr) Write(data []byte) (int, error) {
+	select {
+	case <-p.killed:
+		return 0, io.ErrClosedPipe
+	default:
+		return p.ReadWriter.Write(data)
+	}
+}
+
+// sendExit reports how the emulated process ended the way sshd does:
+// EOF, then exit-status or exit-signal, then the channel close done by the caller.
+func sendExit(c ssh.Channel, info exitInfo, logFile *os.File) error {
+	err := c.CloseWrite()
+	if err != nil {
+		log.Print("close write failed:", err.Error()+"\n")
+		return nil
+	}
+
+	if info.signal != "" {
+		fmt.Fprint(logFile, "ExitSignal:"+info.signal+"\n")
+		_, err = c.SendRequest("exit-signal", false, ssh.Marshal(&exitSignalMsg{Signal: info.signal}))
+	} else {
+		fmt.Fprintf(logFile, "ExitStatus:%d\n", info.status)
+		_, err = c.SendRequest("exit-status", false, ssh.Marshal(&exitStatusMsg{Status: uint32(info.status)}))
+	}
+	if err != nil {
+		log.Print("send exit failed:", err.Error()+"\n")
 	}
 	return nil
 }
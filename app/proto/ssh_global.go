@@ -0,0 +1,104 @@
+package proto
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Payloads of the global requests (RFC 4254 section 7.1).
+
+type tcpipForwardMsg struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type tcpipForwardReplyMsg struct {
+	BindPort uint32
+}
+
+// sessionLimit enforces no-more-sessions@openssh.com on a connection.
+//
+// The global requests and the channels come to different goroutines, so the
+// session the client opened right before the request may be seen after it:
+// only the sessions past the first are refused.
+type sessionLimit struct {
+	mu       sync.Mutex
+	sessions int
+	noMore   bool
+}
+
+func (l *sessionLimit) disable() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.noMore = true
+}
+
+// open counts a new session channel, and tells whether it may be opened.
+func (l *sessionLimit) open() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.noMore && l.sessions > 0 {
+		return false
+	}
+	l.sessions++
+	return true
+}
+
+// handleGlobalRequests services the connection-level requests until the
+// connection is closed. Leaving them unread would stall the whole connection.
+func handleGlobalRequests(sshRequest <-chan *ssh.Request, sessions *sessionLimit, conf *Config, logFile *os.File) {
+	for r := range sshRequest {
+		switch r.Type {
+		case "tcpip-forward", "cancel-tcpip-forward":
+			var msg tcpipForwardMsg
+			if err := ssh.Unmarshal(r.Payload, &msg); err != nil {
+				log.Print("malformed "+r.Type+" payload:", err.Error()+"\n")
+				r.Reply(false, nil)
+				continue
+			}
+
+			if r.Type == "cancel-tcpip-forward" {
+				fmt.Fprintf(logFile, "CancelTcpipForward:%s:%d\n", msg.BindAddr, msg.BindPort)
+				r.Reply(conf.AcceptTCPIPForward, nil)
+				continue
+			}
+
+			fmt.Fprintf(logFile, "TcpipForward:%s:%d\n", msg.BindAddr, msg.BindPort)
+			if !conf.AcceptTCPIPForward {
+				r.Reply(false, nil)
+				continue
+			}
+
+			// the bound port is only sent back when the client let the server pick it
+			var payload []byte
+			if msg.BindPort == 0 {
+				port := uint32(32768 + rand.Intn(60999-32768))
+				fmt.Fprintf(logFile, "TcpipForwardPort:%d\n", port)
+				payload = ssh.Marshal(&tcpipForwardReplyMsg{BindPort: port})
+			}
+			r.Reply(true, payload)
+		case "keepalive@openssh.com":
+			// sshd answers with a failure too, the client only waits for any reply
+			r.Reply(false, nil)
+		case "no-more-sessions@openssh.com":
+			fmt.Fprint(logFile, "NoMoreSessions\n")
+			sessions.disable()
+			// OpenSSH sends it without wanting a reply, sshd succeeds anyway
+			r.Reply(true, nil)
+		case "hostkeys-00@openssh.com", "hostkeys-prove-00@openssh.com":
+			fmt.Fprintf(logFile, "GlobalRequest:%s (%d bytes)\n", r.Type, len(r.Payload))
+			r.Reply(false, nil)
+		default:
+			log.Print("unknown global request type:", r.Type+"\n")
+			fmt.Fprintf(logFile, "GlobalRequest:%s (%d bytes)\n", r.Type, len(r.Payload))
+			r.Reply(false, nil)
+		}
+	}
+}
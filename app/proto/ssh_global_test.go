@@ -0,0 +1,54 @@
+package proto
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNoMoreSessions(t *testing.T) {
+	logFile := testLogFile(t)
+
+	sessions := &sessionLimit{}
+	if !sessions.open() || !sessions.open() {
+		t.Fatal("sessions refused before no-more-sessions")
+	}
+
+	reqs := make(chan *ssh.Request, 1)
+	reqs <- &ssh.Request{Type: "no-more-sessions@openssh.com"}
+	close(reqs)
+	handleGlobalRequests(reqs, sessions, DefaultConfig(), logFile)
+
+	if sessions.open() {
+		t.Error("session opened after no-more-sessions")
+	}
+
+	// the session the request follows may be counted after it
+	late := &sessionLimit{}
+	late.disable()
+	if !late.open() {
+		t.Error("first session refused")
+	}
+	if late.open() {
+		t.Error("second session opened after no-more-sessions")
+	}
+}
+
+func TestNoMoreSessionsReply(t *testing.T) {
+	logFile := testLogFile(t)
+	client, _ := startTestServer(t, DefaultConfig(), logFile)
+
+	ok, _, err := client.SendRequest("no-more-sessions@openssh.com", true, nil)
+	if err != nil || !ok {
+		t.Fatalf("no-more-sessions answered %t, %v", ok, err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal("first session refused:", err)
+	}
+	defer session.Close()
+	if _, err := client.NewSession(); err == nil {
+		t.Error("second session opened after no-more-sessions")
+	}
+}
@@ -0,0 +1,57 @@
+package proto
+
+// Payloads of the "session" channel requests (RFC 4254 section 6).
+// They are decoded with ssh.Unmarshal, so the field order must follow the wire format.
+
+type ptyRequestMsg struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+type envRequestMsg struct {
+	Name  string
+	Value string
+}
+
+type execMsg struct {
+	Command string
+}
+
+type subsystemRequestMsg struct {
+	Subsystem string
+}
+
+type windowChangeMsg struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+type x11RequestMsg struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+type signalMsg struct {
+	Signal string
+}
+
+// Requests sent by the server when the emulated process terminates (RFC 4254 section 6.10).
+
+type exitStatusMsg struct {
+	Status uint32
+}
+
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
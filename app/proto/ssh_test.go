@@ -0,0 +1,114 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSignalStopsProcess(t *testing.T) {
+	logFile := testLogFile(t)
+	client, served := startTestServer(t, DefaultConfig(), logFile)
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("cat"); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin.Write([]byte("hello\n"))
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("cat echoed %q, %v", line, err)
+	}
+
+	if err := session.Signal(ssh.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	err = session.Wait()
+	exitErr, ok := err.(*ssh.ExitError)
+	if !ok || exitErr.Signal() != "KILL" {
+		t.Fatalf("session ended with %v, want signal KILL", err)
+	}
+
+	client.Close()
+	<-served
+
+	// the process is done with the log before its exit is reported
+	log := readLog(t, logFile)
+	artifact := strings.Index(log, "Artifact:stdin")
+	exit := strings.Index(log, "ExitSignal:KILL")
+	if artifact < 0 || exit < 0 || artifact > exit {
+		t.Errorf("want the stdin artifact before the exit signal in:\n%s", log)
+	}
+}
+
+func TestPtyInputLineEnd(t *testing.T) {
+	tests := []struct {
+		modes ssh.TerminalModes
+		in    string
+		out   string
+	}{
+		{nil, "ls\n", "ls\r"},
+		{nil, "ls\r\n", "ls\r\r"},
+		{ssh.TerminalModes{ssh.ICRNL: 1}, "ls\r", "ls\r"},
+		{ssh.TerminalModes{ssh.ICRNL: 0}, "ls\r\n", "ls\r"},
+		{ssh.TerminalModes{ssh.ICRNL: 1, ssh.IGNCR: 1}, "ls\r\n", "ls\r"},
+	}
+
+	for _, test := range tests {
+		var modelist []byte
+		for opcode, value := range test.modes {
+			modelist = append(modelist, opcode, 0, 0, 0, byte(value))
+		}
+		pty := newSessionPty(ptyRequestMsg{Modelist: string(modelist)})
+
+		out, err := ioutil.ReadAll(pty.input(strings.NewReader(test.in)))
+		if err != nil || string(out) != test.out {
+			t.Errorf("%v %q: got %q, %v, want %q", test.modes, test.in, out, err, test.out)
+		}
+	}
+}
+
+func TestPtyShellNewline(t *testing.T) {
+	logFile := testLogFile(t)
+	client, _ := startTestServer(t, DefaultConfig(), logFile)
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	session.Stdout = &out
+	// what paramiko's invoke_shell asks for
+	if err := session.RequestPty("vt100", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin.Write([]byte("exit 3\n"))
+	err = session.Wait()
+	if exitErr, ok := err.(*ssh.ExitError); !ok || exitErr.ExitStatus() != 3 {
+		t.Fatalf("shell ended with %v, want exit status 3 after:\n%s", err, out.String())
+	}
+}
@@ -0,0 +1,325 @@
+package proto
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tarpit counters: clients held and seconds wasted per listener.
+var tarpitStats = expvar.NewMap("tarpit")
+
+// CIDRList is a set of networks, as a flag "10.0.0.0/8,192.0.2.1". It can be repeated.
+type CIDRList []*net.IPNet
+
+func (l *CIDRList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := []string{}
+	for _, n := range *l {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *CIDRList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			// a single address
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+func (l CIDRList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PatternList is a set of regular expressions given by repeating a flag.
+type PatternList []*regexp.Regexp
+
+func (l *PatternList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := []string{}
+	for _, p := range *l {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func (l *PatternList) Set(value string) error {
+	p, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, p)
+	return nil
+}
+
+func (l PatternList) match(s string) bool {
+	for _, p := range l {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionCounter remembers how many connections each address opened, for
+// sending the ones that keep coming back to the tarpit.
+type sessionCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+	last   map[string]time.Time
+	swept  time.Time
+}
+
+var sessionCounts = &sessionCounter{
+	counts: map[string]int{},
+	last:   map[string]time.Time{},
+	swept:  time.Now(),
+}
+
+// add counts a connection from ip and returns how many it has opened so far.
+func (c *sessionCounter) add(ip string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.swept) > time.Hour {
+		// addresses quiet for a day start over
+		c.swept = now
+		for k, t := range c.last {
+			if now.Sub(t) > 24*time.Hour {
+				delete(c.counts, k)
+				delete(c.last, k)
+			}
+		}
+	}
+
+	c.counts[ip]++
+	c.last[ip] = now
+	return c.counts[ip]
+}
+
+// tarpitReason tells why a new connection from ip should go to the tarpit,
+// or returns "". It counts the connection for the per address threshold.
+func tarpitReason(ip string, conf *Config) string {
+	sessions := sessionCounts.add(ip)
+
+	if addr := net.ParseIP(ip); addr != nil && conf.TarpitCIDRs.contains(addr) {
+		return "cidr"
+	}
+	if conf.TarpitAfter > 0 && sessions > conf.TarpitAfter {
+		return fmt.Sprintf("session %d", sessions)
+	}
+	return ""
+}
+
+// bufferedConn is a conn some bytes of which were read ahead of time.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// exchangeVersions sends serverVersion to an ssh client and reads its
+// version, within timeout, as the handshake would. It returns the client's
+// version and a conn to run the handshake on, that reads it again and does
+// not send serverVersion twice.
+func exchangeVersions(conn net.Conn, serverVersion string, timeout time.Duration) (string, net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	_, err := io.WriteString(conn, serverVersion+"\r\n")
+	if err != nil {
+		return "", nil, err
+	}
+
+	// RFC 4253 section 4.2 allows 255 bytes, the reader 4096
+	br := bufio.NewReader(conn)
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return "", nil, err
+	}
+
+	read := append([]byte{}, line...)
+	version := strings.TrimRight(string(read), "\r\n")
+	return version, &versionSentConn{
+		Conn:   conn,
+		r:      io.MultiReader(strings.NewReader(string(read)), br),
+		unsent: []byte(serverVersion + "\r\n"),
+	}, nil
+}
+
+// versionSentConn is a conn whose ssh versions were exchanged already: the
+// version the handshake sends again is dropped.
+type versionSentConn struct {
+	net.Conn
+	r      io.Reader
+	unsent []byte
+}
+
+func (c *versionSentConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *versionSentConn) Write(p []byte) (int, error) {
+	n := 0
+	for len(c.unsent) > 0 && n < len(p) && p[n] == c.unsent[0] {
+		c.unsent = c.unsent[1:]
+		n++
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	c.unsent = nil
+
+	m, err := c.Conn.Write(p[n:])
+	return n + m, err
+}
+
+// sshTarpitPacket starts the packet a client that has the server's version
+// waits for next, the largest RFC 4253 says every client takes: the tarpit
+// lines make its body.
+var sshTarpitPacket = []byte{0, 0, 0x88, 0xb8}
+
+// tarpit holds conn for as long as the client puts up with it, or the tarpit
+// timeout, writing next to nothing. kind picks the protocol, "ssh" or
+// "telnet", and reason is recorded with the time the client was held. onHold,
+// if not nil, is called once conn is held, before anything is sent. It
+// returns false without touching conn when every tarpit slot is taken.
+func tarpit(conn net.Conn, kind string, reason string, conf *Config, onHold func()) bool {
+	l := sharedLimiter(conf)
+	if !l.startTarpit() {
+		log.Print("tarpit full, not holding " + conn.RemoteAddr().String() + "\n")
+		return false
+	}
+	defer l.stopTarpit()
+	defer conn.Close()
+
+	if onHold != nil {
+		onHold()
+	}
+
+	log.Print(kind + " connection from " + conn.RemoteAddr().String() + " sent to the tarpit (" + reason + ")\n")
+	tarpitStats.Add(kind+".clients", 1)
+	tarpitStats.Add(kind+".active", 1)
+	defer tarpitStats.Add(kind+".active", -1)
+
+	// whatever the client says is of no interest, only that it left
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(gone)
+	}()
+
+	start := time.Now()
+	timeout := time.After(conf.TarpitTimeout)
+	sent := 0
+loop:
+	for {
+		select {
+		case <-gone:
+			break loop
+		case <-timeout:
+			break loop
+		case <-time.After(conf.TarpitDelay):
+		}
+
+		var chunk []byte
+		if kind == "ssh" {
+			chunk = tarpitSSHLine()
+		} else {
+			chunk = tarpitTelnetCommand()
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(conf.TarpitDelay))
+		n, err := conn.Write(chunk)
+		sent += n
+		if err != nil {
+			break loop
+		}
+	}
+
+	held := time.Since(start)
+	tarpitStats.AddFloat(kind+".held_seconds", held.Seconds())
+	log.Print("tarpit released " + conn.RemoteAddr().String() + " after " + held.Round(time.Second).String() + "\n")
+	recordTarpit(kind, conn.RemoteAddr().String(), reason, start, held, sent)
+	return true
+}
+
+// tarpitSSHLine is one of the lines a server may send before its version
+// (RFC 4253 section 4.2), the way endlessh does: random, and never starting
+// with "SSH-" so that the client keeps waiting for the real one.
+func tarpitSSHLine() []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 "
+
+	line := make([]byte, 3+rand.Intn(30))
+	for i := range line {
+		line[i] = letters[rand.Intn(len(letters))]
+	}
+	return append(line, '\r', '\n')
+}
+
+// tarpitTelnetCommand is a telnet option negotiation, sent one at a time so
+// that the client never gets to the login prompt.
+func tarpitTelnetCommand() []byte {
+	verbs := []byte{0xFB, 0xFC, 0xFD, 0xFE} // WILL, WONT, DO, DONT
+	return []byte{0xFF, verbs[rand.Intn(len(verbs))], byte(rand.Intn(40))}
+}
+
+var tarpitLogMutex sync.Mutex
+
+// recordTarpit appends a line about a released client to the tarpit log of
+// its listener.
+func recordTarpit(kind string, remoteAddr string, reason string, start time.Time, held time.Duration, sent int) {
+	tarpitLogMutex.Lock()
+	defer tarpitLogMutex.Unlock()
+
+	dir := "./log"
+	if kind == "telnet" {
+		dir = "./telnet-log"
+	}
+
+	f, err := os.OpenFile(dir+"/tarpit.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Print("failed open tarpit log:", err.Error()+"\n")
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "%s %s reason:%s held:%.0fs sent:%d\n", start.UTC().Format(time.RFC3339), remoteAddr, reason, held.Seconds(), sent)
+}
@@ -0,0 +1,60 @@
+package proto
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// the handshake goes on from a version exchange done ahead of it
+func TestExchangeVersions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	const serverVersion = "SSH-2.0-OpenSSH_7.4p1 Raspbian-10+deb9u2"
+	config := &ssh.ServerConfig{NoClientAuth: true, ServerVersion: serverVersion}
+	config.AddHostKey(testSigner(t))
+
+	versions := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		version, conn, err := exchangeVersions(c, serverVersion, 5*time.Second)
+		if err != nil {
+			versions <- "error: " + err.Error()
+			return
+		}
+		versions <- version
+		sshConn, _, _, err := ssh.NewServerConn(conn, config)
+		if err == nil {
+			sshConn.Wait()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "root",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		ClientVersion:   "SSH-2.0-Go-test",
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if got := <-versions; got != "SSH-2.0-Go-test" {
+		t.Errorf("client version %q", got)
+	}
+	if got := string(client.ServerVersion()); got != serverVersion {
+		t.Errorf("server version %q", got)
+	}
+}
@@ -23,13 +23,15 @@ package proto
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
-	"strings"
 	"time"
+
+	"golang.org/x/term"
 )
 
 type Context interface {
@@ -83,6 +85,8 @@ func newDataWriter(w io.Writer) *internalDataWriter {
 type internalDataReader struct {
 	wrapped  io.Reader
 	buffered *bufio.Reader
+	options  *telnetOptions
+	seenData bool
 }
 
 var iaciac []byte = []byte{255, 255}
@@ -148,12 +152,15 @@ func (w *internalDataWriter) Write(data []byte) (n int, err error) {
 	return n, err
 }
 
-func newDataReader(r io.Reader) *internalDataReader {
+// newDataReader strips the telnet commands from r, passing the option
+// negotiation to options.
+func newDataReader(r io.Reader, options *telnetOptions) *internalDataReader {
 	buffered := bufio.NewReader(r)
 
 	reader := internalDataReader{
 		wrapped:  r,
 		buffered: buffered,
+		options:  options,
 	}
 
 	return &reader
@@ -186,16 +193,27 @@ func (r *internalDataReader) Read(data []byte) (n int, err error) {
 
 			peeked, err = r.buffered.Peek(1)
 			if nil != err {
+				if err == io.EOF {
+					r.options.commandError("IAC at the end of the stream")
+				}
 				return n, err
 			}
 
 			switch peeked[0] {
 			case WILL, WONT, DO, DONT:
-				_, err = r.buffered.Discard(2)
+				_, err = r.buffered.Discard(1)
 				if nil != err {
 					return n, err
 				}
+
+				var opt byte
+				opt, err = r.buffered.ReadByte()
+				if nil != err {
+					return n, err
+				}
+				r.options.receive(peeked[0], opt)
 			case IAC:
+				r.sawData()
 				p[0] = IAC
 				n++
 				p = p[1:]
@@ -205,6 +223,12 @@ func (r *internalDataReader) Read(data []byte) (n int, err error) {
 					return n, err
 				}
 			case SB:
+				_, err = r.buffered.Discard(1)
+				if nil != err {
+					return n, err
+				}
+
+				subnegotiation := []byte{}
 				for {
 					var b2 byte
 					b2, err = r.buffered.ReadByte()
@@ -218,34 +242,53 @@ func (r *internalDataReader) Read(data []byte) (n int, err error) {
 							return n, err
 						}
 
-						if IAC == peeked[0] {
+						if SE == peeked[0] {
 							_, err = r.buffered.Discard(1)
 							if nil != err {
 								return n, err
 							}
+							break
 						}
 
-						if SE == peeked[0] {
+						if IAC == peeked[0] {
 							_, err = r.buffered.Discard(1)
 							if nil != err {
 								return n, err
 							}
-							break
+						} else {
+							r.options.commandError(fmt.Sprintf("IAC followed by %d in a subnegotiation", peeked[0]))
 						}
 					}
+
+					if len(subnegotiation) < maxSubnegotiation {
+						subnegotiation = append(subnegotiation, b2)
+					}
 				}
+				r.options.subnegotiation(subnegotiation)
 			case SE:
 				_, err = r.buffered.Discard(1)
 				if nil != err {
 					return n, err
 				}
+				r.options.commandError("SE outside of a subnegotiation")
+			case telnetNOP, telnetDM, telnetBRK, telnetIP, telnetAO, telnetAYT, telnetEC, telnetEL, telnetGA:
+				_, err = r.buffered.Discard(1)
+				if nil != err {
+					return n, err
+				}
+
+				// editing and interrupts become the keys the line discipline knows
+				if key := r.options.command(peeked[0]); key != 0 {
+					p[0] = key
+					n++
+					p = p[1:]
+				}
 			default:
-				// If we get in here, this is not following the TELNET protocol.
-				//@TODO: Make a better error.
-				err = nil
-				return n, err
+				// not a command, IAC is dropped and the byte read as data
+				r.options.commandError(fmt.Sprintf("IAC followed by %d", peeked[0]))
 			}
 		} else {
+			r.sawData()
 
 			p[0] = b
 			n++
@@ -256,143 +299,231 @@ func (r *internalDataReader) Read(data []byte) (n int, err error) {
 	return n, nil
 }
 
+func (r *internalDataReader) sawData() {
+	if !r.seenData {
+		r.seenData = true
+		r.options.sawData()
+	}
+}
+
 type ReadWriter struct {
 	io.Reader
 	io.Writer
 }
 
-func StartTelnetServer() {
-	tcpListener, err := net.Listen("tcp", "0.0.0.0:5555")
+func StartTelnetServer(conf *Config) {
+	tcpListener, err := listenAll(conf.TelnetAddrs)
 	if err != nil {
-		log.Fatalf("failed to listen on 5555 (%s)", err)
+		log.Fatalf("failed to listen on %s (%s)", conf.TelnetAddrs.String(), err)
 	}
 	defer tcpListener.Close()
 
-	log.Print("listening on 5555 port")
+	log.Print("listening on " + conf.TelnetAddrs.String())
 
 	if _, err := os.Stat("./telnet-log"); os.IsNotExist(err) {
 		os.Mkdir("./telnet-log", 0766)
 	}
 
-	timeoutSec := 30
+	commandList, err := os.OpenFile("./telnet-log/commands.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Fatal("failed open log file:", err)
+	}
 
-	log.Print("ssh timeout is ", timeoutSec, "s")
+	signatures := []telnetSignature{}
+	if conf.TelnetSignatures != "" {
+		signatures, err = loadTelnetSignatures(conf.TelnetSignatures)
+		if os.IsNotExist(err) {
+			log.Print("no telnet signatures at " + conf.TelnetSignatures + ", every client is unknown\n")
+		} else if err != nil {
+			log.Fatal("failed to load telnet signatures:", err)
+		} else {
+			log.Printf("loaded %d telnet signatures", len(signatures))
+		}
+	}
 
-	for {
+	log.Print("telnet timeouts are auth ", conf.AuthTimeout, ", idle ", conf.IdleTimeout, ", session ", conf.SessionTimeout)
 
-		telnetConn, err := tcpListener.Accept()
+	if len(conf.TelnetTLSAddrs) > 0 {
+		certificates, err := telnetCertificates(conf)
 		if err != nil {
-			log.Fatalf("failed to listen on 5555 (%s)", err)
+			log.Fatal("failed to load the telnet TLS certificate:", err)
 		}
-		defer telnetConn.Close()
-
-		go func() {
-
-			go func() {
-				time.Sleep(time.Duration(timeoutSec) * time.Second)
-				log.Println("timeout")
-				err = telnetConn.Close()
-				if err != nil {
-					log.Println(err)
-				}
-			}()
-
-			utcTime := time.Now().UTC().Format(time.RFC3339Nano)
-
-			remoteIP := strings.Split(telnetConn.RemoteAddr().String(), ":")[0]
-
-			if _, err := os.Stat(remoteIP); os.IsNotExist(err) {
-				os.Mkdir("./telnet-log/"+remoteIP, 0766)
-			}
-
-			logFileName := "./telnet-log/" + remoteIP + "/" + utcTime + ".txt"
 
-			logFile, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE, 0666)
-			if err != nil {
-				log.Fatal("failed open log file:", err)
-			}
-			log.Print("new ssh connection from " + telnetConn.RemoteAddr().String() + "\n")
-			fmt.Fprint(logFile, "RemoteAddr:"+telnetConn.RemoteAddr().String()+"\n")
-			fmt.Fprint(logFile, "Time:"+utcTime+"\n")
-
-			telnetConn.Write([]byte{0xFF, 0xFD, 0x18, 0xFF, 0xFD, 0x20, 0xFF, 0xFD, 0x23, 0xFF, 0xFD, 0x27})
-			// telnetConn.Write([]byte{0x6c, 0x6f, 0x67, 0x69, 0x6e, 0x3a, 0x20})
-			// telnetConn.Write([]byte{0x50, 0x61, 0x73, 0x73, 0x77, 0x6f, 0x72, 0x64, 0x3a})
-			// telnetConn.Write([]byte("\r\r\n"))
-
-			r := newDataReader(telnetConn)
-			w := newDataWriter(telnetConn)
-
-			readBuff := []byte{0}
-
-			commandBuff := []byte{}
-
-			w.Write([]byte("login: "))
+		tlsListener, err := listenAll(conf.TelnetTLSAddrs)
+		if err != nil {
+			log.Fatalf("failed to listen on %s (%s)", conf.TelnetTLSAddrs.String(), err)
+		}
+		defer tlsListener.Close()
 
-			lfCount := 0
+		log.Print("listening on " + conf.TelnetTLSAddrs.String() + " (TLS)")
+		go acceptTelnet(tlsListener, conf, commandList, signatures, certificates)
+	}
 
-			commandCount := 0
+	acceptTelnet(tcpListener, conf, commandList, signatures, nil)
+}
 
-			for {
+// acceptTelnet serves the clients of listener, over TLS when certificates is
+// not nil.
+func acceptTelnet(listener net.Listener, conf *Config, commandList *os.File, signatures []telnetSignature, certificates map[string]tls.Certificate) {
+	for {
 
-				_, err := r.Read(readBuff)
-				if nil != err {
-					log.Print(err)
-					break
-				}
+		tcpConn, err := listener.Accept()
+		if err != nil {
+			log.Println("listener accept failed:", err)
+			// most likely out of file descriptors, give the open connections time to end
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
 
-				if readBuff[0] == 0x0a { // cr lf を lfの扱いに統一
-					readBuff[0] = 0x0d
-				}
+		go handleTelnetConn(tcpConn, conf, commandList, signatures, certificates)
+	}
+}
 
-				readOneByte := readBuff[0]
+// handleTelnetConn serves a telnet client, over TLS with the certificate
+// of the persona when certificates is not nil.
+func handleTelnetConn(tcpConn net.Conn, conf *Config, commandList *os.File, signatures []telnetSignature, certificates map[string]tls.Certificate) {
+	// over TLS the busy banner and the tarpit, both plain telnet, would
+	// only break the handshake
+	banner := "Too many connections, try again later.\r\n"
+	if certificates != nil {
+		banner = ""
+	}
 
-				if readOneByte == 0x0d {
+	// counted before the PROXY header, which can take a while to come
+	release, ok := acceptGlobal(tcpConn, "telnet", conf, banner)
+	if !ok {
+		return
+	}
+	defer release()
 
-					if len(commandBuff) == 0 { // lf の処理
-						lfCount += 1
-						if lfCount == 2 {
-							w.Write([]byte("> "))
-							lfCount = 0
-						}
+	conn, err := acceptProxyHeader(tcpConn, conf, telnetProxyHeaderWait)
+	if err != nil {
+		log.Print("PROXY header from "+tcpConn.RemoteAddr().String()+" rejected:", err.Error()+"\n")
+		tcpConn.Close()
+		return
+	}
+	proxyAddr := proxyAddrOf(conn)
 
-						continue
-					}
+	done, ok := acceptLimited(conn, "telnet", conf, banner)
+	if !ok {
+		return
+	}
+	defer done()
+
+	// with the tarpit full the client gets the real thing
+	if reason := tarpitReason(remoteIPOf(conn), conf); reason != "" {
+		if certificates != nil {
+			log.Print("telnet connection from " + conn.RemoteAddr().String() + " not sent to the tarpit (" + reason + "), it speaks TLS\n")
+		} else if tarpit(conn, "telnet", reason, conf, func() {
+			// the tarpit has its own limit
+			done()
+			release()
+		}) {
+			return
+		}
+	}
 
-					lfCount = 0
+	telnetConn := newGuardedConn(conn, conf.SessionTimeout)
+	defer telnetConn.Close()
 
-					command := string(commandBuff)
-					commandBuff = []byte{}
+	if certificates != nil {
+		telnetConn.setPhase(phaseHandshake, conf.HandshakeTimeout)
+	} else {
+		// telnet has no handshake to speak of, the login prompt comes right away
+		telnetConn.setPhase(phaseAuth, conf.AuthTimeout)
+	}
 
-					commandCount += 1
+	now := time.Now()
+	utcTime := now.UTC().Format(time.RFC3339Nano)
 
-					if commandCount == 1 { // userID
-						fmt.Println("your user is", command)
-						fmt.Fprint(logFile, "User:"+command+"\n")
+	logFile, err := createSessionLog("./telnet-log", telnetConn.RemoteAddr(), now)
+	if err != nil {
+		log.Print("failed open log file:", err.Error()+"\n")
+		return
+	}
+	defer logFile.Close()
+	if proxyAddr != "" {
+		log.Print("new telnet connection from " + telnetConn.RemoteAddr().String() + " via " + proxyAddr + "\n")
+	} else {
+		log.Print("new telnet connection from " + telnetConn.RemoteAddr().String() + "\n")
+	}
+	fmt.Fprint(logFile, "RemoteAddr:"+telnetConn.RemoteAddr().String()+"\n")
+	if proxyAddr != "" {
+		fmt.Fprint(logFile, "ProxyAddr:"+proxyAddr+"\n")
+	}
+	fmt.Fprint(logFile, "Time:"+utcTime+"\n")
 
-						w.Write([]byte("password: "))
-					} else if commandCount == 2 { // password
-						fmt.Println("your password is", command)
-						fmt.Fprint(logFile, "Password:"+command+"\n")
-						fmt.Fprint(logFile, "RequestTyped:Shell"+"\n-----\n")
+	// the persona the same address gets over ssh
+	kernelInfo := personaFor(remoteIPOf(conn), conf)
+	fmt.Fprint(logFile, "OS:"+kernelInfo+"\n")
 
-						w.Write([]byte("> "))
-					} else {
-						// w.Write([]byte(command + "\r\n"))
-						fmt.Println(">", command)
-						w.Write([]byte(command + "\r\n"))
+	// what the telnet layer reads and writes, the TLS connection if any
+	var sessionConn net.Conn = telnetConn
+	if certificates != nil {
+		tlsConn, err := acceptTLS(telnetConn, certificates[kernelInfo], logFile)
+		if err != nil {
+			log.Print("telnet TLS handshake with "+telnetConn.RemoteAddr().String()+" failed:", err.Error()+"\n")
+			telnetConn.Close()
+			fmt.Fprint(logFile, "Disconnect:"+telnetConn.closeReason()+"\n")
+			return
+		}
+		sessionConn = tlsConn
+		telnetConn.setPhase(phaseAuth, conf.AuthTimeout)
+	}
 
-						fmt.Fprint(logFile, "$ "+string(command)+"\n")
-						if command == "exit" {
-							telnetConn.Close()
-							break
-						}
-						w.Write([]byte("> "))
-					}
-				} else {
-					commandBuff = append(commandBuff, readOneByte)
-				}
-			}
-		}()
+	// sized by NAWS, 80x24 until the client tells
+	pty := newSessionPty(ptyRequestMsg{Columns: 80, Rows: 24})
+
+	options := newTelnetOptions(sessionConn, logFile, pty)
+	// character mode: the client sends each key as typed and leaves
+	// the echo to us, so that the password is not shown
+	options.enableLocal(optEcho)
+	options.enableLocal(optSGA)
+	options.enableRemote(optTTYPE)
+	options.enableRemote(optNAWS)
+	options.enableRemote(optTSPEED)
+	options.enableRemote(optXDISPLOC)
+	options.enableRemote(optNewEnviron)
+
+	// logged last, once the client has shown all it does
+	defer func() {
+		f := options.clientFingerprint(signatures)
+		telnetClientStats.Add(f.label, 1)
+		fmt.Fprint(logFile, "TelnetFingerprint:"+f.String()+"\n")
+	}()
+
+	r := newDataReader(sessionConn, options)
+	w := newDataWriter(sessionConn)
+
+	t := term.NewTerminal(ReadWriter{&telnetInput{r: r, options: options}, w}, "")
+	pty.attach(t)
+
+	userName, password, ok, err := telnetLogin(t, options, kernelInfo, telnetConn.RemoteAddr().String(), conf, logFile)
+	if err != nil {
+		log.Print(err)
+		fmt.Fprint(logFile, "Disconnect:"+telnetConn.closeReason()+"\n")
+		return
+	}
+	if !ok {
+		fmt.Fprint(logFile, "TelnetOptions:"+options.String()+"\n")
+		fmt.Fprint(logFile, "TelnetClient:"+options.fingerprint()+"\n")
+		telnetConn.Close()
+		fmt.Fprint(logFile, "Disconnect:"+telnetConn.closeReason()+"\n")
+		return
+	}
+	fmt.Fprint(logFile, "User:"+userName+"\n")
+	fmt.Fprint(logFile, "Password:"+password+"\n")
+	fmt.Fprint(logFile, "TelnetOptions:"+options.String()+"\n")
+	fmt.Fprint(logFile, "TelnetClient:"+options.fingerprint()+"\n")
+	fmt.Fprint(logFile, "RequestTyped:Shell"+"\n-----\n")
+	telnetConn.setPhase(phaseSession, conf.IdleTimeout)
+
+	info, err := handleTelnetShell(t, options, logFile, commandList, userName, kernelInfo)
+	if err != nil {
+		log.Print("handle shell error:", err.Error()+"\n")
+	} else {
+		fmt.Fprintf(logFile, "ExitStatus:%d\n", info.status)
 	}
+	telnetConn.Close()
+	fmt.Fprint(logFile, "Disconnect:"+telnetConn.closeReason()+"\n")
 }
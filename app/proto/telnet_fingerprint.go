@@ -0,0 +1,242 @@
+package proto
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// telnet clients seen, per signature label.
+var telnetClientStats = expvar.NewMap("telnet_clients")
+
+// most option responses kept for the fingerprint.
+const maxRecordedResponses = 32
+
+// telnetBehavior is how the client acted, as opposed to what it claimed.
+type telnetBehavior struct {
+	start time.Time
+	// the WILL, WONT, DO and DONT of the client, in order, as "DO-ECHO"
+	responses []string
+	// time from the connection to the first byte of data, -1 until then
+	firstData time.Duration
+	// how the first line ended: crlf, crnul, lf or cr
+	lineEnding string
+	// login pairs tried, and how the last one went
+	logins      int
+	loginResult string
+}
+
+// the fields of a fingerprint, in the order they are logged.
+var fingerprintFields = []string{"options", "ttype", "naws", "ending", "first", "login"}
+
+// the fields hashed into the id, those of the client implementation; first
+// and login depend on the network and the session, and are only matched.
+var fingerprintIDFields = []string{"options", "ttype", "naws", "ending"}
+
+// telnetFingerprint identifies a client implementation: id is a hash of the
+// fields it is made of, label the signature it matched or "unknown".
+type telnetFingerprint struct {
+	id     string
+	label  string
+	fields map[string]string
+}
+
+func (f telnetFingerprint) String() string {
+	s := []string{f.id, f.label}
+	for _, name := range fingerprintFields {
+		s = append(s, name+"="+f.fields[name])
+	}
+	return strings.Join(s, " ")
+}
+
+func (o *telnetOptions) response(command byte, opt byte) {
+	if len(o.behavior.responses) >= maxRecordedResponses {
+		return
+	}
+	verb := map[byte]string{telnetWILL: "WILL", telnetWONT: "WONT", telnetDO: "DO", telnetDONT: "DONT"}[command]
+	o.behavior.responses = append(o.behavior.responses, verb+"-"+telnetOptionName(opt))
+}
+
+// sawData notes the arrival of the first byte of data.
+func (o *telnetOptions) sawData() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.behavior.firstData < 0 {
+		o.behavior.firstData = time.Since(o.behavior.start)
+	}
+}
+
+// sawLineEnding notes how the client ends its lines, the first time only.
+func (o *telnetOptions) sawLineEnding(ending string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.behavior.lineEnding == "" {
+		o.behavior.lineEnding = ending
+	}
+}
+
+// sawLogin notes a login attempt and its result: accepted, failed, or
+// refused once the client is out of tries.
+func (o *telnetOptions) sawLogin(result string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if result != "refused" {
+		o.behavior.logins++
+	}
+	o.behavior.loginResult = result
+}
+
+// clientFingerprint sums up the client so far and labels it with the first
+// of signatures it matches.
+func (o *telnetOptions) clientFingerprint(signatures []telnetSignature) telnetFingerprint {
+	o.mu.Lock()
+	b := o.behavior
+	c := o.client
+	o.mu.Unlock()
+
+	// coarse, the round trip time of the client is in there too
+	first := "none"
+	switch {
+	case b.firstData < 0:
+	case b.firstData < time.Second:
+		first = "fast"
+	default:
+		first = "slow"
+	}
+
+	naws := ""
+	if c.columns != 0 || c.rows != 0 {
+		naws = fmt.Sprintf("%dx%d", c.columns, c.rows)
+	}
+
+	loginResult := b.loginResult
+	if loginResult == "" {
+		loginResult = "none"
+	}
+
+	f := telnetFingerprint{
+		fields: map[string]string{
+			"options": strings.Join(b.responses, ","),
+			"ttype":   fingerprintValue(strings.Join(c.terminalTypes, ",")),
+			"naws":    naws,
+			"ending":  b.lineEnding,
+			"first":   first,
+			"login":   fmt.Sprintf("%d:%s", b.logins, loginResult),
+		},
+	}
+
+	h := sha256.New()
+	for _, name := range fingerprintIDFields {
+		fmt.Fprintf(h, "%s=%s\n", name, f.fields[name])
+	}
+	f.id = hex.EncodeToString(h.Sum(nil)[:8])
+	f.fields["id"] = f.id
+
+	f.label = "unknown"
+	for _, s := range signatures {
+		if s.matches(f.fields) {
+			f.label = s.label
+			break
+		}
+	}
+	return f
+}
+
+// fingerprintValue keeps what the client sent from breaking the fields
+// apart: anything but printable ASCII, space included, becomes "_".
+func fingerprintValue(s string) string {
+	b := []byte(s)
+	for i := range b {
+		if b[i] <= ' ' || b[i] > '~' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// telnetSignature labels the fingerprints whose fields all have the values
+// of match. A value ending with "*" matches the fields starting with the rest.
+type telnetSignature struct {
+	label string
+	match map[string]string
+}
+
+func (s telnetSignature) matches(fields map[string]string) bool {
+	for name, want := range s.match {
+		got := fields[name]
+		if strings.HasSuffix(want, "*") {
+			if !strings.HasPrefix(got, strings.TrimSuffix(want, "*")) {
+				return false
+			}
+		} else if got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// loadTelnetSignatures reads a signature file: one signature per line, the
+// label then name=value pairs, such as
+//
+//	mirai options=DO-ECHO,DO-SGA,WONT-TTYPE,WILL-NAWS* naws=80x24
+//	my-scanner id=3a4c0d1f2e5b6a79
+//
+// "#" starts a comment. The first signature that matches wins.
+func loadTelnetSignatures(path string) ([]telnetSignature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	signatures := []telnetSignature{}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+		if len(words) == 1 {
+			return nil, fmt.Errorf("%s:%d: signature %s matches nothing", path, lineNumber, words[0])
+		}
+
+		s := telnetSignature{label: words[0], match: map[string]string{}}
+		for _, word := range words[1:] {
+			eq := strings.Index(word, "=")
+			if eq < 0 {
+				return nil, fmt.Errorf("%s:%d: %q is not name=value", path, lineNumber, word)
+			}
+			name := word[:eq]
+			if name != "id" && !isFingerprintField(name) {
+				return nil, fmt.Errorf("%s:%d: unknown field %q", path, lineNumber, name)
+			}
+			s.match[name] = word[eq+1:]
+		}
+		signatures = append(signatures, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return signatures, nil
+}
+
+func isFingerprintField(name string) bool {
+	for _, field := range fingerprintFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package proto
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testClient is a telnet client that answered the server's offers with
+// responses, reported a window of columns x rows, and acted as told.
+func testClient(responses string, columns, rows uint16, ending string, firstData time.Duration, logins ...string) *telnetOptions {
+	o := newTelnetOptions(ioutil.Discard, nil, nil)
+	if responses != "" {
+		o.behavior.responses = strings.Split(responses, ",")
+	}
+	o.client.columns, o.client.rows = columns, rows
+	o.behavior.lineEnding = ending
+	o.behavior.firstData = firstData
+	for _, result := range logins {
+		o.sawLogin(result)
+	}
+	return o
+}
+
+func TestShippedTelnetSignatures(t *testing.T) {
+	signatures, err := loadTelnetSignatures("../../telnet-signatures.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		mirai     = "DO-ECHO,DO-SGA,WONT-TTYPE,WILL-NAWS,WONT-TSPEED,WONT-XDISPLOC,WONT-NEW-ENVIRON"
+		gafgyt    = "DONT-ECHO,DONT-SGA,WONT-TTYPE,WONT-NAWS,WONT-TSPEED,WONT-XDISPLOC,WONT-NEW-ENVIRON"
+		inetutils = "DO-ECHO,DO-SGA,WILL-TTYPE,WILL-NAWS,WILL-TSPEED,WILL-XDISPLOC,WILL-NEW-ENVIRON"
+	)
+
+	tests := []struct {
+		name   string
+		client *telnetOptions
+		label  string
+	}{
+		{"mirai", testClient(mirai, 80, 24, "crlf", 10*time.Millisecond, "failed", "failed"), "mirai"},
+		{"mirai slow", testClient(mirai, 80, 24, "crlf", 3*time.Second, "accepted"), "mirai"},
+		{"mirai other window", testClient(mirai, 132, 43, "crlf", 10*time.Millisecond), "unknown"},
+		{"gafgyt", testClient(gafgyt, 0, 0, "crlf", 10*time.Millisecond, "failed"), "gafgyt"},
+		{"scanner", testClient("", 0, 0, "lf", 10*time.Millisecond, "failed"), "scanner"},
+		{"banner grabber", testClient("", 0, 0, "", -1), "banner-grabber"},
+		{"silent after a login", testClient("", 0, 0, "", 3*time.Second, "failed"), "unknown"},
+		{"inetutils telnet", testClient(inetutils, 80, 24, "crnul", 2*time.Second, "failed"), "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.client.clientFingerprint(signatures)
+			if f.label != tt.label {
+				t.Errorf("labeled %q, want %q: %s", f.label, tt.label, f)
+			}
+		})
+	}
+}
+
+func TestTelnetFingerprintID(t *testing.T) {
+	const responses = "DO-ECHO,DO-SGA,WONT-TTYPE,WILL-NAWS"
+
+	base := testClient(responses, 80, 24, "crlf", 10*time.Millisecond, "failed").clientFingerprint(nil)
+
+	// the same client on another network, or trying more passwords
+	same := testClient(responses, 80, 24, "crlf", 3*time.Second, "failed", "failed", "accepted").clientFingerprint(nil)
+	if same.id != base.id {
+		t.Errorf("id changed with first and login: %s, %s", base, same)
+	}
+	if same.fields["first"] != "slow" || same.fields["login"] != "3:accepted" {
+		t.Errorf("first and login not kept as fields: %s", same)
+	}
+
+	// another client
+	for _, other := range []*telnetOptions{
+		testClient(responses+",WONT-TSPEED", 80, 24, "crlf", 10*time.Millisecond),
+		testClient(responses, 80, 25, "crlf", 10*time.Millisecond),
+		testClient(responses, 80, 24, "crnul", 10*time.Millisecond),
+	} {
+		f := other.clientFingerprint(nil)
+		if f.id == base.id {
+			t.Errorf("%s and %s share an id", f, base)
+		}
+	}
+
+	// a signature can still name the id
+	signatures := []telnetSignature{{label: "mine", match: map[string]string{"id": base.id}}}
+	if f := testClient(responses, 80, 24, "crlf", -1).clientFingerprint(signatures); f.label != "mine" {
+		t.Errorf("id signature not matched: %s", f)
+	}
+}
+
+func TestLoadTelnetSignaturesErrors(t *testing.T) {
+	for _, content := range []string{
+		"lonely\n",
+		"bad options\n",
+		"bad color=red\n",
+	} {
+		f, err := ioutil.TempFile("", "signatures")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(content)
+		f.Close()
+
+		_, err = loadTelnetSignatures(f.Name())
+		os.Remove(f.Name())
+		if err == nil {
+			t.Errorf("%q loaded", content)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package proto
+
+import (
+	"io"
+)
+
+// control keys as they come from a telnet client in character mode.
+const (
+	keyInterrupt = 0x03 // Ctrl-C
+	keyBackspace = 0x08 // Ctrl-H, what some clients send for backspace
+	keyKill      = 0x15 // Ctrl-U
+	keyDelete    = 0x7f
+)
+
+// telnetInput turns what a telnet client types into what term.Terminal
+// expects: a single '\r' for every end of line (CR LF, CR NUL, or a bare LF
+// from clients that are not quite telnet), DEL for backspace, and Ctrl-C as
+// killing the line and starting over instead of ending the session. The
+// line editing itself, and the echo, are done by the terminal. The line
+// ending the client uses goes to options.
+type telnetInput struct {
+	r       io.Reader
+	options *telnetOptions
+	lastCR  bool
+	pending []byte
+}
+
+func (t *telnetInput) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for len(t.pending) == 0 {
+		// one byte at a time, the data reader waits until p is full
+		b := []byte{0}
+		_, err := t.r.Read(b)
+		if err != nil {
+			return 0, err
+		}
+		t.pending = t.translate(b[0])
+	}
+
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+// translate returns what b stands for, nothing for the second half of a
+// CR LF or CR NUL.
+func (t *telnetInput) translate(b byte) []byte {
+	lastCR := t.lastCR
+	t.lastCR = b == '\r'
+
+	if lastCR && b != '\n' && b != 0 {
+		t.options.sawLineEnding("cr")
+	}
+
+	switch b {
+	case '\r':
+		return []byte{'\r'}
+	case '\n':
+		if lastCR {
+			t.options.sawLineEnding("crlf")
+			return nil
+		}
+		t.options.sawLineEnding("lf")
+		return []byte{'\r'}
+	case 0:
+		if lastCR {
+			t.options.sawLineEnding("crnul")
+			return nil
+		}
+		return []byte{0}
+	case keyBackspace:
+		return []byte{keyDelete}
+	case keyInterrupt:
+		return []byte{keyKill, '\r'}
+	}
+	return []byte{b}
+}
@@ -0,0 +1,176 @@
+package proto
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// telnetPersona is what login(1) shows on the telnet console of a persona:
+// the /etc/issue text and the prompts.
+type telnetPersona struct {
+	issue          string
+	loginPrompt    string
+	passwordPrompt string
+}
+
+var telnetPersonas = map[string]telnetPersona{
+	Ubuntu: {
+		issue:          "Ubuntu 16.04.3 LTS\n",
+		loginPrompt:    "ubuntu login: ",
+		passwordPrompt: "Password: ",
+	},
+	KaliLinux: {
+		issue:          "Kali GNU/Linux Rolling\n",
+		loginPrompt:    "kali login: ",
+		passwordPrompt: "Password: ",
+	},
+	RaspberryPi: {
+		issue:          "Raspbian GNU/Linux 8\n",
+		loginPrompt:    "raspberrypi login: ",
+		passwordPrompt: "Password: ",
+	},
+	AmazonLinux: {
+		issue:          "Amazon Linux 2\nKernel 4.10.109-90.92.amzn2.x86_64 on an x86_64\n",
+		loginPrompt:    "ip-170-31-81-10 login: ",
+		passwordPrompt: "Password: ",
+	},
+	CentOS: {
+		issue:          "CentOS Linux 7 (Core)\nKernel 3.10.0-327.28.2.el7.x86_64 on an x86_64\n",
+		loginPrompt:    "cent login: ",
+		passwordPrompt: "Password: ",
+	},
+	Debian: {
+		issue:          "Debian GNU/Linux 7\n",
+		loginPrompt:    "debian login: ",
+		passwordPrompt: "Password: ",
+	},
+}
+
+// PromptMap replaces the prompts of the personas, given by repeating a flag
+// as "Persona=prompt" for one of them, or as the prompt alone for all.
+type PromptMap map[string]string
+
+func (m *PromptMap) String() string {
+	if m == nil {
+		return ""
+	}
+	keys := []string{}
+	for k := range *m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := []string{}
+	for _, k := range keys {
+		if k == "" {
+			s = append(s, fmt.Sprintf("%q", (*m)[k]))
+		} else {
+			s = append(s, fmt.Sprintf("%q", k+"="+(*m)[k]))
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+func (m *PromptMap) Set(value string) error {
+	if *m == nil {
+		*m = PromptMap{}
+	}
+	if eq := strings.Index(value, "="); eq > 0 {
+		for _, persona := range personas {
+			if value[:eq] == persona {
+				(*m)[persona] = value[eq+1:]
+				return nil
+			}
+		}
+	}
+	(*m)[""] = value
+	return nil
+}
+
+// prompt is the prompt of persona: its own, the one for all, or def.
+func (m PromptMap) prompt(persona string, def string) string {
+	if p, ok := m[persona]; ok {
+		return p
+	}
+	if p, ok := m[""]; ok {
+		return p
+	}
+	return def
+}
+
+// telnetLogin asks for a user name and a password until a pair is accepted,
+// as login(1) started by telnetd does. Every pair is recorded, and told to
+// options for the fingerprint. ok is false when the client is out of tries.
+func telnetLogin(t *term.Terminal, options *telnetOptions, kernelInfo string, remoteAddr string, conf *Config, logFile *os.File) (userName string, password string, ok bool, err error) {
+	persona := telnetPersonas[kernelInfo]
+	persona.loginPrompt = conf.TelnetLoginPrompt.prompt(kernelInfo, persona.loginPrompt)
+	persona.passwordPrompt = conf.TelnetPasswordPrompt.prompt(kernelInfo, persona.passwordPrompt)
+
+	fmt.Fprint(t, persona.issue+"\n")
+
+	tries := 0
+	for {
+		t.SetPrompt(persona.loginPrompt)
+		userName, err = readTerminalLine(t, persona.loginPrompt, options.serverEcho)
+		if err != nil {
+			return "", "", false, err
+		}
+		if strings.TrimSpace(userName) == "" {
+			// login asks again without wanting a password
+			continue
+		}
+
+		password, err = t.ReadPassword(persona.passwordPrompt)
+		if err != nil {
+			return "", "", false, err
+		}
+
+		tries++
+		accepted := conf.TelnetAcceptAfter > 0 && tries >= conf.TelnetAcceptAfter
+		result := "failed"
+		if accepted {
+			result = "accepted"
+		}
+		fmt.Fprintf(logFile, "LoginAttempt:%d %q %q %s\n", tries, userName, password, result)
+		recordLogin(remoteAddr, kernelInfo, userName, password, result)
+		options.sawLogin(result)
+
+		if accepted {
+			return userName, password, true, nil
+		}
+
+		// FAIL_DELAY of login.defs, the message only comes after it
+		time.Sleep(conf.TelnetFailDelay)
+		fmt.Fprint(t, "\nLogin incorrect\n")
+
+		if conf.TelnetMaxTries > 0 && tries >= conf.TelnetMaxTries {
+			options.sawLogin("refused")
+			return "", "", false, nil
+		}
+	}
+}
+
+var loginLogMutex sync.Mutex
+
+// recordLogin appends a login attempt to ./telnet-log/auth.txt, the list of
+// every pair tried on the telnet server.
+func recordLogin(remoteAddr string, kernelInfo string, userName string, password string, result string) {
+	loginLogMutex.Lock()
+	defer loginLogMutex.Unlock()
+
+	f, err := os.OpenFile("./telnet-log/auth.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		log.Print("failed open auth log:", err.Error()+"\n")
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "%s %s %s %q %q %s\n", time.Now().UTC().Format(time.RFC3339), remoteAddr, kernelInfo, userName, password, result)
+}
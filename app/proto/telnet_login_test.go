@@ -0,0 +1,34 @@
+package proto
+
+import "testing"
+
+func TestPromptMap(t *testing.T) {
+	var m PromptMap
+	if got := m.prompt(CentOS, "cent login: "); got != "cent login: " {
+		t.Errorf("unset prompt %q", got)
+	}
+
+	for _, value := range []string{"CentOS=Username: ", "login= ", "Debian=debian=login: "} {
+		if err := m.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		persona string
+		want    string
+	}{
+		{CentOS, "Username: "},
+		{Debian, "debian=login: "},
+		// not a persona, the whole value is the prompt of the others
+		{Ubuntu, "login= "},
+	}
+	for _, tt := range tests {
+		if got := m.prompt(tt.persona, "default: "); got != tt.want {
+			t.Errorf("prompt of %s %q, want %q", tt.persona, got, tt.want)
+		}
+	}
+	if got := m.String(); got != `"login= " "CentOS=Username: " "Debian=debian=login: "` {
+		t.Errorf("String() = %s", got)
+	}
+}
@@ -0,0 +1,396 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// telnet commands (RFC 854).
+const (
+	telnetSE   = 240
+	telnetNOP  = 241
+	telnetDM   = 242
+	telnetBRK  = 243
+	telnetIP   = 244
+	telnetAO   = 245
+	telnetAYT  = 246
+	telnetEC   = 247
+	telnetEL   = 248
+	telnetGA   = 249
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+var telnetCommandNames = map[byte]string{
+	telnetNOP: "NOP",
+	telnetDM:  "DM",
+	telnetBRK: "BRK",
+	telnetIP:  "IP",
+	telnetAO:  "AO",
+	telnetAYT: "AYT",
+	telnetEC:  "EC",
+	telnetEL:  "EL",
+	telnetGA:  "GA",
+}
+
+// telnet options.
+const (
+	optBinary     = 0
+	optEcho       = 1
+	optSGA        = 3
+	optStatus     = 5
+	optTimingMark = 6
+	optTTYPE      = 24
+	optNAWS       = 31
+	optTSPEED     = 32
+	optLFLOW      = 33
+	optLinemode   = 34
+	optXDISPLOC   = 35
+	optEnviron    = 36
+	optNewEnviron = 39
+)
+
+var telnetOptionNames = map[byte]string{
+	optBinary:     "BINARY",
+	optEcho:       "ECHO",
+	optSGA:        "SGA",
+	optStatus:     "STATUS",
+	optTimingMark: "TIMING-MARK",
+	optTTYPE:      "TTYPE",
+	optNAWS:       "NAWS",
+	optTSPEED:     "TSPEED",
+	optLFLOW:      "LFLOW",
+	optLinemode:   "LINEMODE",
+	optXDISPLOC:   "XDISPLOC",
+	optEnviron:    "ENVIRON",
+	optNewEnviron: "NEW-ENVIRON",
+	37:            "AUTHENTICATION",
+	38:            "ENCRYPT",
+	42:            "CHARSET",
+}
+
+func telnetOptionName(opt byte) string {
+	if name, ok := telnetOptionNames[opt]; ok {
+		return name
+	}
+	return fmt.Sprintf("OPT%d", opt)
+}
+
+// states of one side of an option in the Q method of RFC 1143.
+const (
+	qNo = iota
+	qYes
+	qWantNo
+	qWantYes
+)
+
+// optionSide is the state of an option on one side of the connection, and
+// whether the opposite of what is being negotiated was asked meanwhile.
+type optionSide struct {
+	state    int
+	opposite bool
+}
+
+// telnetOptions negotiates the options of a telnet connection with the Q
+// method of RFC 1143, which answers each request at most once and so cannot
+// loop. "local" options are performed by the server (WILL/WONT from us,
+// DO/DONT from the client), "remote" ones by the client.
+type telnetOptions struct {
+	mu      sync.Mutex
+	w       io.Writer
+	logFile *os.File
+
+	local  [256]optionSide
+	remote [256]optionSide
+
+	// options either side may enable when asked to
+	acceptLocal  map[byte]bool
+	acceptRemote map[byte]bool
+
+	// what the client reported in subnegotiations, NAWS resizing pty
+	client telnetClient
+	pty    *sessionPty
+
+	// what the client did, for its fingerprint
+	behavior telnetBehavior
+}
+
+// newTelnetOptions negotiates on w, which must be the raw connection, and
+// logs every option that gets enabled or disabled to logFile. The window
+// size and terminal type the client reports go to pty.
+func newTelnetOptions(w io.Writer, logFile *os.File, pty *sessionPty) *telnetOptions {
+	return &telnetOptions{
+		w:       w,
+		logFile: logFile,
+		pty:     pty,
+		client: telnetClient{
+			environ: map[string]string{},
+		},
+		behavior: telnetBehavior{
+			start:     time.Now(),
+			firstData: -1,
+		},
+		acceptLocal: map[byte]bool{
+			optBinary: true,
+			optSGA:    true,
+		},
+		acceptRemote: map[byte]bool{
+			optBinary:     true,
+			optSGA:        true,
+			optTTYPE:      true,
+			optNAWS:       true,
+			optTSPEED:     true,
+			optXDISPLOC:   true,
+			optNewEnviron: true,
+		},
+	}
+}
+
+// receive handles a WILL, WONT, DO or DONT from the client.
+func (o *telnetOptions) receive(command byte, opt byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.response(command, opt)
+
+	switch command {
+	case telnetWILL:
+		o.received(&o.remote[opt], true, o.acceptRemote[opt], opt, "remote", telnetDO, telnetDONT)
+	case telnetWONT:
+		o.received(&o.remote[opt], false, false, opt, "remote", telnetDO, telnetDONT)
+	case telnetDO:
+		o.received(&o.local[opt], true, o.acceptLocal[opt], opt, "local", telnetWILL, telnetWONT)
+	case telnetDONT:
+		o.received(&o.local[opt], false, false, opt, "local", telnetWILL, telnetWONT)
+	}
+}
+
+// received applies a request to enable (or disable) side, answering with
+// the yes or no verb, as in section 7 of RFC 1143.
+func (o *telnetOptions) received(side *optionSide, enable bool, agree bool, opt byte, sideName string, yes byte, no byte) {
+	if enable {
+		switch side.state {
+		case qNo:
+			if agree {
+				o.send(yes, opt)
+				o.set(side, qYes, opt, sideName)
+			} else {
+				o.send(no, opt)
+			}
+		case qYes:
+			// already enabled, answering again is what loops
+		case qWantNo:
+			o.protocolError(opt, sideName, "disable answered by enable")
+			if side.opposite {
+				side.opposite = false
+				o.set(side, qYes, opt, sideName)
+			} else {
+				o.set(side, qNo, opt, sideName)
+			}
+		case qWantYes:
+			if side.opposite {
+				side.opposite = false
+				side.state = qWantNo
+				o.send(no, opt)
+			} else {
+				o.set(side, qYes, opt, sideName)
+			}
+		}
+		return
+	}
+
+	switch side.state {
+	case qNo:
+	case qYes:
+		o.set(side, qNo, opt, sideName)
+		o.send(no, opt)
+	case qWantNo:
+		if side.opposite {
+			side.opposite = false
+			side.state = qWantYes
+			o.send(yes, opt)
+		} else {
+			o.set(side, qNo, opt, sideName)
+		}
+	case qWantYes:
+		// refused
+		side.opposite = false
+		o.set(side, qNo, opt, sideName)
+	}
+}
+
+// ask starts enabling (or disabling) side on our initiative.
+func (o *telnetOptions) ask(side *optionSide, enable bool, opt byte, yes byte, no byte) {
+	want, wantState, verb := qYes, qWantYes, yes
+	if !enable {
+		want, wantState, verb = qNo, qWantNo, no
+	}
+
+	switch side.state {
+	case want:
+	case wantState:
+		side.opposite = false
+	case qYes, qNo:
+		side.state = wantState
+		o.send(verb, opt)
+	default:
+		// negotiating the other way, ask again once it is over
+		side.opposite = true
+	}
+}
+
+// enableLocal offers to perform opt (WILL).
+func (o *telnetOptions) enableLocal(opt byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.acceptLocal[opt] = true
+	o.ask(&o.local[opt], true, opt, telnetWILL, telnetWONT)
+}
+
+// disableLocal stops performing opt (WONT).
+func (o *telnetOptions) disableLocal(opt byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.ask(&o.local[opt], false, opt, telnetWILL, telnetWONT)
+}
+
+// enableRemote asks the client to perform opt (DO).
+func (o *telnetOptions) enableRemote(opt byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.acceptRemote[opt] = true
+	o.ask(&o.remote[opt], true, opt, telnetDO, telnetDONT)
+}
+
+// disableRemote asks the client to stop performing opt (DONT).
+func (o *telnetOptions) disableRemote(opt byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.ask(&o.remote[opt], false, opt, telnetDO, telnetDONT)
+}
+
+func (o *telnetOptions) localEnabled(opt byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.local[opt].state == qYes
+}
+
+// serverEcho tells whether what the client types is to be echoed back: not
+// when it refused WILL ECHO, it shows it itself then. Until it answers it is
+// echoed, as before the negotiation.
+func (o *telnetOptions) serverEcho() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.local[optEcho].state != qNo
+}
+
+func (o *telnetOptions) remoteEnabled(opt byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.remote[opt].state == qYes
+}
+
+// enabled lists the options in effect, as "local:ECHO" and "remote:NAWS".
+func (o *telnetOptions) enabled() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	list := []string{}
+	for i := 0; i < 256; i++ {
+		if o.local[i].state == qYes {
+			list = append(list, "local:"+telnetOptionName(byte(i)))
+		}
+		if o.remote[i].state == qYes {
+			list = append(list, "remote:"+telnetOptionName(byte(i)))
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (o *telnetOptions) set(side *optionSide, state int, opt byte, sideName string) {
+	side.state = state
+	if state == qYes {
+		fmt.Fprint(o.logFile, "TelnetOption:"+sideName+" "+telnetOptionName(opt)+" on\n")
+		if side == &o.remote[opt] {
+			o.requestSubnegotiation(opt)
+		}
+	} else if state == qNo {
+		fmt.Fprint(o.logFile, "TelnetOption:"+sideName+" "+telnetOptionName(opt)+" off\n")
+	}
+}
+
+func (o *telnetOptions) send(verb byte, opt byte) {
+	_, err := o.w.Write([]byte{telnetIAC, verb, opt})
+	if err != nil {
+		log.Print("telnet negotiation failed:", err.Error()+"\n")
+	}
+}
+
+// command carries out one of the commands of RFC 854 that take no option,
+// and returns the key it stands for in the data stream, or 0.
+func (o *telnetOptions) command(cmd byte) byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fmt.Fprint(o.logFile, "TelnetCommand:"+telnetCommandNames[cmd]+"\n")
+
+	switch cmd {
+	case telnetIP, telnetBRK:
+		// telnetd sends both to the process as SIGINT
+		return keyInterrupt
+	case telnetEC:
+		return keyDelete
+	case telnetEL:
+		return keyKill
+	case telnetAYT:
+		o.write([]byte("\r\n[Yes]\r\n"))
+	case telnetAO:
+		// there is no output waiting to be thrown away, only the synch is left
+		// to send to tell the client where the output resumes
+		o.write([]byte{telnetIAC, telnetDM})
+	}
+	// NOP, GA, and DM which ends a synch we have nothing to discard for
+	return 0
+}
+
+func (o *telnetOptions) write(data []byte) {
+	_, err := o.w.Write(data)
+	if err != nil {
+		log.Print("telnet command answer failed:", err.Error()+"\n")
+	}
+}
+
+// commandError logs a sequence that is not valid telnet.
+func (o *telnetOptions) commandError(msg string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fmt.Fprint(o.logFile, "TelnetProtocolError:"+msg+"\n")
+}
+
+func (o *telnetOptions) protocolError(opt byte, sideName string, msg string) {
+	fmt.Fprint(o.logFile, "TelnetProtocolError:"+sideName+" "+telnetOptionName(opt)+" "+msg+"\n")
+}
+
+// String lists the enabled options for logs.
+func (o *telnetOptions) String() string {
+	return strings.Join(o.enabled(), ",")
+}
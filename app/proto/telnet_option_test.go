@@ -0,0 +1,204 @@
+package proto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTelnetOptionNegotiation(t *testing.T) {
+	const charset = 42
+
+	tests := []struct {
+		name   string
+		setup  func(o *telnetOptions)
+		in     []byte // pairs of verb and option from the client
+		opt    byte
+		out    []byte
+		local  int
+		remote int
+		logged string
+	}{
+		{
+			name: "refuse unknown local",
+			in:   []byte{telnetDO, charset},
+			opt:  charset,
+			out:  []byte{telnetIAC, telnetWONT, charset},
+		},
+		{
+			name: "refuse unknown remote",
+			in:   []byte{telnetWILL, charset},
+			opt:  charset,
+			out:  []byte{telnetIAC, telnetDONT, charset},
+		},
+		{
+			name:  "accept local",
+			in:    []byte{telnetDO, optSGA},
+			opt:   optSGA,
+			out:   []byte{telnetIAC, telnetWILL, optSGA},
+			local: qYes,
+		},
+		{
+			name:   "accept remote and ask for its value",
+			in:     []byte{telnetWILL, optTTYPE},
+			opt:    optTTYPE,
+			out:    []byte{telnetIAC, telnetDO, optTTYPE, telnetIAC, telnetSB, optTTYPE, subnegSEND, telnetIAC, telnetSE},
+			remote: qYes,
+		},
+		{
+			name:  "no reply when already enabled",
+			in:    []byte{telnetDO, optSGA, telnetDO, optSGA},
+			opt:   optSGA,
+			out:   []byte{telnetIAC, telnetWILL, optSGA},
+			local: qYes,
+		},
+		{
+			name: "no reply when already disabled",
+			in:   []byte{telnetWONT, optSGA, telnetDONT, optSGA},
+			opt:  optSGA,
+		},
+		{
+			name: "disable on request",
+			in:   []byte{telnetDO, optSGA, telnetDONT, optSGA},
+			opt:  optSGA,
+			out:  []byte{telnetIAC, telnetWILL, optSGA, telnetIAC, telnetWONT, optSGA},
+		},
+		{
+			name:  "WANTYES answered",
+			setup: func(o *telnetOptions) { o.enableLocal(optEcho) },
+			in:    []byte{telnetDO, optEcho},
+			opt:   optEcho,
+			out:   []byte{telnetIAC, telnetWILL, optEcho},
+			local: qYes,
+		},
+		{
+			name:  "WANTYES refused",
+			setup: func(o *telnetOptions) { o.enableLocal(optEcho) },
+			in:    []byte{telnetDONT, optEcho},
+			opt:   optEcho,
+			out:   []byte{telnetIAC, telnetWILL, optEcho},
+		},
+		{
+			name: "WANTYES opposite answered",
+			setup: func(o *telnetOptions) {
+				o.enableLocal(optEcho)
+				o.disableLocal(optEcho)
+			},
+			in:    []byte{telnetDO, optEcho},
+			opt:   optEcho,
+			out:   []byte{telnetIAC, telnetWILL, optEcho, telnetIAC, telnetWONT, optEcho},
+			local: qWantNo,
+		},
+		{
+			name: "WANTYES opposite refused",
+			setup: func(o *telnetOptions) {
+				o.enableLocal(optEcho)
+				o.disableLocal(optEcho)
+			},
+			in:  []byte{telnetDONT, optEcho},
+			opt: optEcho,
+			out: []byte{telnetIAC, telnetWILL, optEcho},
+		},
+		{
+			name: "WANTNO answered",
+			setup: func(o *telnetOptions) {
+				o.receive(telnetDO, optSGA)
+				o.disableLocal(optSGA)
+			},
+			in:  []byte{telnetDONT, optSGA},
+			opt: optSGA,
+			out: []byte{telnetIAC, telnetWILL, optSGA, telnetIAC, telnetWONT, optSGA},
+		},
+		{
+			name: "WANTNO answered by enable",
+			setup: func(o *telnetOptions) {
+				o.receive(telnetDO, optSGA)
+				o.disableLocal(optSGA)
+			},
+			in:     []byte{telnetDO, optSGA},
+			opt:    optSGA,
+			out:    []byte{telnetIAC, telnetWILL, optSGA, telnetIAC, telnetWONT, optSGA},
+			logged: "TelnetProtocolError:local SGA disable answered by enable\n",
+		},
+		{
+			name: "WANTNO opposite answered",
+			setup: func(o *telnetOptions) {
+				o.receive(telnetDO, optSGA)
+				o.disableLocal(optSGA)
+				o.enableLocal(optSGA)
+			},
+			in:    []byte{telnetDONT, optSGA},
+			opt:   optSGA,
+			out:   []byte{telnetIAC, telnetWILL, optSGA, telnetIAC, telnetWONT, optSGA, telnetIAC, telnetWILL, optSGA},
+			local: qWantYes,
+		},
+		{
+			name: "WANTNO opposite answered by enable",
+			setup: func(o *telnetOptions) {
+				o.receive(telnetDO, optSGA)
+				o.disableLocal(optSGA)
+				o.enableLocal(optSGA)
+			},
+			in:     []byte{telnetDO, optSGA},
+			opt:    optSGA,
+			out:    []byte{telnetIAC, telnetWILL, optSGA, telnetIAC, telnetWONT, optSGA},
+			local:  qYes,
+			logged: "TelnetProtocolError:local SGA disable answered by enable\n",
+		},
+		{
+			name:   "remote WANTYES answered",
+			setup:  func(o *telnetOptions) { o.enableRemote(optNAWS) },
+			in:     []byte{telnetWILL, optNAWS},
+			opt:    optNAWS,
+			out:    []byte{telnetIAC, telnetDO, optNAWS},
+			remote: qYes,
+		},
+		{
+			name:  "remote WANTYES refused",
+			setup: func(o *telnetOptions) { o.enableRemote(optNAWS) },
+			in:    []byte{telnetWONT, optNAWS},
+			opt:   optNAWS,
+			out:   []byte{telnetIAC, telnetDO, optNAWS},
+		},
+		{
+			name: "remote WANTNO opposite answered",
+			setup: func(o *telnetOptions) {
+				o.receive(telnetWILL, optSGA)
+				o.disableRemote(optSGA)
+				o.enableRemote(optSGA)
+			},
+			in:     []byte{telnetWONT, optSGA},
+			opt:    optSGA,
+			out:    []byte{telnetIAC, telnetDO, optSGA, telnetIAC, telnetDONT, optSGA, telnetIAC, telnetDO, optSGA},
+			remote: qWantYes,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logFile := testLogFile(t)
+			var buf bytes.Buffer
+			o := newTelnetOptions(&buf, logFile, nil)
+
+			if test.setup != nil {
+				test.setup(o)
+			}
+			for i := 0; i+1 < len(test.in); i += 2 {
+				o.receive(test.in[i], test.in[i+1])
+			}
+
+			if !bytes.Equal(buf.Bytes(), test.out) {
+				t.Errorf("sent %v, want %v", buf.Bytes(), test.out)
+			}
+			if o.local[test.opt].state != test.local || o.remote[test.opt].state != test.remote {
+				t.Errorf("local %d remote %d, want %d %d", o.local[test.opt].state, o.remote[test.opt].state, test.local, test.remote)
+			}
+			if o.local[test.opt].opposite || o.remote[test.opt].opposite {
+				t.Error("opposite left pending")
+			}
+			if log := readLog(t, logFile); !strings.Contains(log, test.logged) {
+				t.Errorf("log %q, want %q", log, test.logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package proto
+
+import (
+	"os"
+
+	"golang.org/x/term"
+)
+
+// handleTelnetShell runs the shell of the ssh sessions over a telnet
+// connection: same persona header, prompt, commands and logs, the persona
+// being the one personaFor gives the address on ssh too. t does the echo
+// and the line editing, on the data of the connection with the telnet
+// commands already taken out, unless the client echoes itself.
+func handleTelnetShell(t *term.Terminal, options *telnetOptions, logFile *os.File, commandList *os.File, userName string, kernelInfo string) (exitInfo, error) {
+	return serveTerminal(t, shellPrompt(userName, kernelInfo), options.serverEcho, logFile, commandList, kernelInfo)
+}
@@ -0,0 +1,75 @@
+package proto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/term"
+)
+
+// the telnet shell is the ssh one, with telnet line endings translated both
+// ways, and echo left to the client when it refused WILL ECHO
+func TestTelnetShell(t *testing.T) {
+	for _, refuse := range []bool{false, true} {
+		out, logData, ending := runTelnetShell(t, refuse)
+
+		header, err := loginHeader(Debian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prompt := shellPrompt("root", Debian) + "\x1b[0m"
+		echoed := "uname -a"
+		if refuse {
+			echoed = ""
+		}
+		for _, want := range []string{
+			strings.Replace(header, "\n", "\r\n", -1),
+			prompt + echoed + "\r\n",
+			"Linux debian 3.2.0-4-amd64 #1 SMP Debian 3.2.65-1+deb7u2 x86_64 GNU/Linux\r\n",
+			"bash: wget: command not found\r\n",
+			"logout\r\n",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("refused echo %t: output lacks %q:\n%q", refuse, want, out)
+			}
+		}
+		if refuse && strings.Contains(out, "wget x") {
+			t.Errorf("echoed to a client that echoes itself:\n%q", out)
+		}
+
+		for _, want := range []string{"$ uname -a\n", "$ wget x\n"} {
+			if !strings.Contains(logData, want) {
+				t.Errorf("session log lacks %q:\n%s", want, logData)
+			}
+		}
+		if ending != "crlf" {
+			t.Errorf("line ending %q", ending)
+		}
+	}
+}
+
+func runTelnetShell(t *testing.T, refuseEcho bool) (out string, logData string, ending string) {
+	logFile := testLogFile(t)
+
+	options := newTelnetOptions(ioutil.Discard, logFile, nil)
+	options.enableLocal(optEcho)
+	if refuseEcho {
+		options.receive(telnetDONT, optEcho)
+	}
+
+	input := &telnetInput{r: strings.NewReader("uname -a\r\nwget x\r\x00exit\n"), options: options}
+	var output bytes.Buffer
+	tm := term.NewTerminal(ReadWriter{input, &output}, "")
+
+	info, err := handleTelnetShell(tm, options, logFile, logFile, "root", Debian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.exited {
+		t.Error("exit did not end the shell")
+	}
+
+	return output.String(), readLog(t, logFile), options.clientFingerprint(nil).fields["ending"]
+}
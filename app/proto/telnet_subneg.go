@@ -0,0 +1,225 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// subnegotiation verbs: IS and SEND (RFC 1091, 1079, 1096, 1572), INFO (RFC 1572).
+const (
+	subnegIS   = 0
+	subnegSEND = 1
+	subnegINFO = 2
+)
+
+// NEW-ENVIRON list items (RFC 1572).
+const (
+	environVAR     = 0
+	environVALUE   = 1
+	environESC     = 2
+	environUSERVAR = 3
+)
+
+// longest subnegotiation kept, the rest is dropped.
+const maxSubnegotiation = 4096
+
+// how many terminal types are asked for, clients cycle through their list
+// on each SEND and repeat the last one when they are done (RFC 1091).
+const maxTerminalTypes = 8
+
+// most environment variables recorded from a client.
+const maxEnvironVars = 64
+
+// telnetClient is what the client told about itself in subnegotiations.
+type telnetClient struct {
+	terminalTypes []string
+	columns       uint16
+	rows          uint16
+	speed         string
+	xdisplay      string
+	environ       map[string]string
+	environOrder  []string
+}
+
+// requestSubnegotiation asks the client for the value of opt once it has
+// agreed to send it. Called with o.mu held.
+func (o *telnetOptions) requestSubnegotiation(opt byte) {
+	switch opt {
+	case optTTYPE, optTSPEED, optXDISPLOC, optNewEnviron:
+		// a NEW-ENVIRON SEND without a list asks for every variable
+		o.sendSubnegotiation(opt, []byte{subnegSEND})
+	}
+}
+
+func (o *telnetOptions) sendSubnegotiation(opt byte, data []byte) {
+	msg := []byte{telnetIAC, telnetSB, opt}
+	for _, b := range data {
+		msg = append(msg, b)
+		if b == telnetIAC {
+			msg = append(msg, telnetIAC)
+		}
+	}
+	msg = append(msg, telnetIAC, telnetSE)
+
+	_, err := o.w.Write(msg)
+	if err != nil {
+		o.protocolError(opt, "local", "subnegotiation not sent: "+err.Error())
+	}
+}
+
+// subnegotiation handles the content of an IAC SB ... IAC SE, option
+// first, with the doubled IACs undone.
+func (o *telnetOptions) subnegotiation(data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(data) == 0 {
+		o.protocolError(0, "remote", "empty subnegotiation")
+		return
+	}
+
+	opt, data := data[0], data[1:]
+	if o.remote[opt].state != qYes && opt != optNAWS {
+		// NAWS is sometimes sent along with the WILL
+		o.protocolError(opt, "remote", "subnegotiation of an option not enabled")
+	}
+
+	switch opt {
+	case optTTYPE:
+		if len(data) < 1 || data[0] != subnegIS {
+			o.protocolError(opt, "remote", "malformed subnegotiation")
+			return
+		}
+		name := string(data[1:])
+		fmt.Fprintf(o.logFile, "TelnetTTYPE:%q\n", name)
+		for _, t := range o.client.terminalTypes {
+			if t == name {
+				// the list is over
+				return
+			}
+		}
+		o.client.terminalTypes = append(o.client.terminalTypes, name)
+		if o.pty != nil && len(o.client.terminalTypes) == 1 {
+			o.pty.setTerm(name)
+		}
+		if len(o.client.terminalTypes) < maxTerminalTypes {
+			o.sendSubnegotiation(optTTYPE, []byte{subnegSEND})
+		}
+	case optNAWS:
+		if len(data) != 4 {
+			o.protocolError(opt, "remote", "malformed subnegotiation")
+			return
+		}
+		o.client.columns = binary.BigEndian.Uint16(data[0:2])
+		o.client.rows = binary.BigEndian.Uint16(data[2:4])
+		fmt.Fprintf(o.logFile, "TelnetNAWS:%dx%d\n", o.client.columns, o.client.rows)
+		if o.pty != nil {
+			o.pty.resize(uint32(o.client.columns), uint32(o.client.rows))
+		}
+	case optTSPEED:
+		if len(data) < 1 || data[0] != subnegIS {
+			o.protocolError(opt, "remote", "malformed subnegotiation")
+			return
+		}
+		o.client.speed = string(data[1:])
+		fmt.Fprintf(o.logFile, "TelnetTSPEED:%q\n", o.client.speed)
+	case optXDISPLOC:
+		if len(data) < 1 || data[0] != subnegIS {
+			o.protocolError(opt, "remote", "malformed subnegotiation")
+			return
+		}
+		o.client.xdisplay = string(data[1:])
+		fmt.Fprintf(o.logFile, "TelnetXDISPLOC:%q\n", o.client.xdisplay)
+	case optNewEnviron:
+		if len(data) < 1 || (data[0] != subnegIS && data[0] != subnegINFO) {
+			o.protocolError(opt, "remote", "malformed subnegotiation")
+			return
+		}
+		o.environ(data[1:])
+	default:
+		fmt.Fprintf(o.logFile, "TelnetSubnegotiation:%s %x\n", telnetOptionName(opt), data)
+	}
+}
+
+// environ records a NEW-ENVIRON list: VAR or USERVAR, a name, then VALUE
+// and the value, ESC quoting the next byte.
+func (o *telnetOptions) environ(data []byte) {
+	var name, value []byte
+	var kind byte
+	inValue := false
+	started := false
+
+	flush := func() {
+		if !started {
+			return
+		}
+		prefix := ""
+		if kind == environUSERVAR {
+			prefix = "USERVAR "
+		}
+		fmt.Fprintf(o.logFile, "TelnetEnv:%s%q=%q\n", prefix, name, value)
+
+		key := string(name)
+		if _, ok := o.client.environ[key]; !ok {
+			if len(o.client.environOrder) >= maxEnvironVars {
+				return
+			}
+			o.client.environOrder = append(o.client.environOrder, key)
+		}
+		o.client.environ[key] = string(value)
+	}
+
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch b {
+		case environVAR, environUSERVAR:
+			flush()
+			kind, name, value, inValue, started = b, nil, nil, false, true
+			continue
+		case environVALUE:
+			inValue = true
+			continue
+		case environESC:
+			if i+1 < len(data) {
+				i++
+				b = data[i]
+			}
+		}
+
+		if inValue {
+			value = append(value, b)
+		} else {
+			name = append(name, b)
+		}
+	}
+	flush()
+}
+
+// fingerprint summarizes what the client reported, for the session log.
+func (o *telnetOptions) fingerprint() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	c := o.client
+	fields := []string{}
+	if len(c.terminalTypes) > 0 {
+		fields = append(fields, "ttype="+strings.Join(c.terminalTypes, ","))
+	}
+	if c.columns != 0 || c.rows != 0 {
+		fields = append(fields, fmt.Sprintf("naws=%dx%d", c.columns, c.rows))
+	}
+	if c.speed != "" {
+		fields = append(fields, "tspeed="+c.speed)
+	}
+	if c.xdisplay != "" {
+		fields = append(fields, "xdisploc="+c.xdisplay)
+	}
+	if len(c.environOrder) > 0 {
+		names := append([]string{}, c.environOrder...)
+		sort.Strings(names)
+		fields = append(fields, "env="+strings.Join(names, ","))
+	}
+	return fmt.Sprintf("%q", strings.Join(fields, " "))
+}
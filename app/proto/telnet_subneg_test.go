@@ -0,0 +1,205 @@
+package proto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// sb wraps data in IAC SB opt ... IAC SE, as it is on the wire.
+func sb(opt byte, data ...byte) []byte {
+	return append(append([]byte{telnetIAC, telnetSB, opt}, data...), telnetIAC, telnetSE)
+}
+
+func TestTelnetSubnegotiation(t *testing.T) {
+	is := func(opt byte, value string) []byte {
+		return sb(opt, append([]byte{subnegIS}, value...)...)
+	}
+	send := func(opt byte) []byte {
+		return sb(opt, subnegSEND)
+	}
+
+	tests := []struct {
+		name        string
+		enabled     []byte
+		in          []byte
+		out         []byte
+		data        string
+		logged      []string
+		fingerprint string
+	}{
+		{
+			name:        "ttype",
+			enabled:     []byte{optTTYPE},
+			in:          is(optTTYPE, "XTERM"),
+			out:         send(optTTYPE),
+			logged:      []string{`TelnetTTYPE:"XTERM"`},
+			fingerprint: `"ttype=XTERM"`,
+		},
+		{
+			name:        "ttype list ends on a repeat",
+			enabled:     []byte{optTTYPE},
+			in:          append(is(optTTYPE, "XTERM"), append(is(optTTYPE, "VT100"), is(optTTYPE, "VT100")...)...),
+			out:         append(send(optTTYPE), send(optTTYPE)...),
+			fingerprint: `"ttype=XTERM,VT100"`,
+		},
+		{
+			name:        "ttype without IS",
+			enabled:     []byte{optTTYPE},
+			in:          sb(optTTYPE, subnegSEND),
+			logged:      []string{"TelnetProtocolError:remote TTYPE malformed subnegotiation"},
+			fingerprint: `""`,
+		},
+		{
+			name:        "ttype not enabled",
+			in:          is(optTTYPE, "XTERM"),
+			out:         send(optTTYPE),
+			logged:      []string{"TelnetProtocolError:remote TTYPE subnegotiation of an option not enabled", `TelnetTTYPE:"XTERM"`},
+			fingerprint: `"ttype=XTERM"`,
+		},
+		{
+			name:        "naws",
+			in:          sb(optNAWS, 0, 80, 0, 24),
+			logged:      []string{"TelnetNAWS:80x24"},
+			fingerprint: `"naws=80x24"`,
+		},
+		{
+			name:        "naws with escaped IAC",
+			in:          sb(optNAWS, 1, telnetIAC, telnetIAC, 0, 24),
+			logged:      []string{"TelnetNAWS:511x24"},
+			fingerprint: `"naws=511x24"`,
+		},
+		{
+			name:        "naws with escaped IAC in the height",
+			in:          sb(optNAWS, 0, 80, telnetIAC, telnetIAC, telnetIAC, telnetIAC),
+			logged:      []string{"TelnetNAWS:80x65535"},
+			fingerprint: `"naws=80x65535"`,
+		},
+		{
+			name:        "naws with a lone IAC",
+			in:          sb(optNAWS, 0, telnetIAC, 0, 24),
+			logged:      []string{"TelnetProtocolError:IAC followed by 0 in a subnegotiation", "TelnetNAWS:255x24"},
+			fingerprint: `"naws=255x24"`,
+		},
+		{
+			name:        "naws too short",
+			in:          sb(optNAWS, 0, 80, 0),
+			logged:      []string{"TelnetProtocolError:remote NAWS malformed subnegotiation"},
+			fingerprint: `""`,
+		},
+		{
+			name:        "tspeed",
+			enabled:     []byte{optTSPEED},
+			in:          is(optTSPEED, "38400,38400"),
+			logged:      []string{`TelnetTSPEED:"38400,38400"`},
+			fingerprint: `"tspeed=38400,38400"`,
+		},
+		{
+			name:        "tspeed empty",
+			enabled:     []byte{optTSPEED},
+			in:          sb(optTSPEED),
+			logged:      []string{"TelnetProtocolError:remote TSPEED malformed subnegotiation"},
+			fingerprint: `""`,
+		},
+		{
+			name:        "xdisploc",
+			enabled:     []byte{optXDISPLOC},
+			in:          is(optXDISPLOC, "host:0.0"),
+			logged:      []string{`TelnetXDISPLOC:"host:0.0"`},
+			fingerprint: `"xdisploc=host:0.0"`,
+		},
+		{
+			name:        "xdisploc without IS",
+			enabled:     []byte{optXDISPLOC},
+			in:          sb(optXDISPLOC, 'h'),
+			logged:      []string{"TelnetProtocolError:remote XDISPLOC malformed subnegotiation"},
+			fingerprint: `""`,
+		},
+		{
+			name:    "new-environ",
+			enabled: []byte{optNewEnviron},
+			in: sb(optNewEnviron, subnegIS,
+				environVAR, 'U', 'S', 'E', 'R', environVALUE, 'r', 'o', 'o', 't',
+				environUSERVAR, 'X', environVALUE, 'a', environESC, environVAR, 'b',
+				environVAR, 'D', 'I', 'S', 'P', 'L', 'A', 'Y'),
+			logged:      []string{`TelnetEnv:"USER"="root"`, `TelnetEnv:USERVAR "X"="a\x00b"`, `TelnetEnv:"DISPLAY"=""`},
+			fingerprint: `"env=DISPLAY,USER,X"`,
+		},
+		{
+			name:        "new-environ info",
+			enabled:     []byte{optNewEnviron},
+			in:          sb(optNewEnviron, subnegINFO, environVAR, 'T', environVALUE, environESC),
+			logged:      []string{`TelnetEnv:"T"="\x02"`},
+			fingerprint: `"env=T"`,
+		},
+		{
+			name:        "new-environ send",
+			enabled:     []byte{optNewEnviron},
+			in:          sb(optNewEnviron, subnegSEND),
+			logged:      []string{"TelnetProtocolError:remote NEW-ENVIRON malformed subnegotiation"},
+			fingerprint: `""`,
+		},
+		{
+			name:        "empty",
+			in:          []byte{telnetIAC, telnetSB, telnetIAC, telnetSE},
+			logged:      []string{"TelnetProtocolError:remote BINARY empty subnegotiation"},
+			fingerprint: `""`,
+		},
+		{
+			name:        "unknown option",
+			in:          sb(42, 1, 2),
+			logged:      []string{"TelnetSubnegotiation:CHARSET 0102"},
+			fingerprint: `""`,
+		},
+		{
+			name:        "truncated",
+			in:          append([]byte("ls"), telnetIAC, telnetSB, optNAWS, 0, 80),
+			data:        "ls",
+			fingerprint: `""`,
+		},
+		{
+			name:        "truncated after IAC",
+			in:          append([]byte("ls"), append(sb(optNAWS, 0, 80, 0, 24), telnetIAC, telnetSB, optNAWS, telnetIAC)...),
+			data:        "ls",
+			logged:      []string{"TelnetNAWS:80x24"},
+			fingerprint: `"naws=80x24"`,
+		},
+		{
+			name:        "data around",
+			in:          append([]byte("a"), append(sb(optNAWS, 0, 80, 0, 24), 'b')...),
+			data:        "ab",
+			fingerprint: `"naws=80x24"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logFile := testLogFile(t)
+			var buf bytes.Buffer
+			pty := newSessionPty(ptyRequestMsg{})
+			o := newTelnetOptions(&buf, logFile, pty)
+			for _, opt := range test.enabled {
+				o.enableRemote(opt)
+				o.receive(telnetWILL, opt)
+			}
+			buf.Reset()
+
+			data := readTelnet(t, o, test.in)
+			if data != test.data {
+				t.Errorf("data %q, want %q", data, test.data)
+			}
+			if !bytes.Equal(buf.Bytes(), test.out) {
+				t.Errorf("sent %v, want %v", buf.Bytes(), test.out)
+			}
+			log := readLog(t, logFile)
+			for _, line := range test.logged {
+				if !strings.Contains(log, line+"\n") {
+					t.Errorf("%q not in log:\n%s", line, log)
+				}
+			}
+			if fingerprint := o.fingerprint(); fingerprint != test.fingerprint {
+				t.Errorf("fingerprint %s, want %s", fingerprint, test.fingerprint)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package proto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTelnetCommands(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []byte
+		data   string
+		out    []byte
+		logged []string
+	}{
+		{
+			name:   "IP",
+			in:     []byte{'l', 's', telnetIAC, telnetIP},
+			data:   "ls\x03",
+			logged: []string{"TelnetCommand:IP"},
+		},
+		{
+			name:   "BRK",
+			in:     []byte{telnetIAC, telnetBRK, 'x'},
+			data:   "\x03x",
+			logged: []string{"TelnetCommand:BRK"},
+		},
+		{
+			name:   "EC",
+			in:     []byte{'l', 's', telnetIAC, telnetEC},
+			data:   "ls\x7f",
+			logged: []string{"TelnetCommand:EC"},
+		},
+		{
+			name:   "EL",
+			in:     []byte{'l', 's', telnetIAC, telnetEL, 'i', 'd'},
+			data:   "ls\x15id",
+			logged: []string{"TelnetCommand:EL"},
+		},
+		{
+			name:   "AYT",
+			in:     []byte{telnetIAC, telnetAYT},
+			out:    []byte("\r\n[Yes]\r\n"),
+			logged: []string{"TelnetCommand:AYT"},
+		},
+		{
+			name:   "AO",
+			in:     []byte{telnetIAC, telnetAO},
+			out:    []byte{telnetIAC, telnetDM},
+			logged: []string{"TelnetCommand:AO"},
+		},
+		{
+			name:   "NOP, GA and DM",
+			in:     []byte{'a', telnetIAC, telnetNOP, telnetIAC, telnetGA, telnetIAC, telnetDM, 'b'},
+			data:   "ab",
+			logged: []string{"TelnetCommand:NOP", "TelnetCommand:GA", "TelnetCommand:DM"},
+		},
+		{
+			name: "escaped IAC",
+			in:   []byte{'a', telnetIAC, telnetIAC, 'b'},
+			data: "a\xffb",
+		},
+		{
+			name:   "unknown command",
+			in:     []byte{'a', telnetIAC, 'b'},
+			data:   "ab",
+			logged: []string{"TelnetProtocolError:IAC followed by 98"},
+		},
+		{
+			name:   "SE alone",
+			in:     []byte{telnetIAC, telnetSE, 'a'},
+			data:   "a",
+			logged: []string{"TelnetProtocolError:SE outside of a subnegotiation"},
+		},
+		{
+			name:   "end of stream",
+			in:     []byte{'a', telnetIAC},
+			data:   "a",
+			logged: []string{"TelnetProtocolError:IAC at the end of the stream"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logFile := testLogFile(t)
+			var buf bytes.Buffer
+			o := newTelnetOptions(&buf, logFile, nil)
+
+			data := readTelnet(t, o, test.in)
+			if data != test.data {
+				t.Errorf("data %q, want %q", data, test.data)
+			}
+			if !bytes.Equal(buf.Bytes(), test.out) {
+				t.Errorf("sent %q, want %q", buf.Bytes(), test.out)
+			}
+			log := readLog(t, logFile)
+			for _, line := range test.logged {
+				if !strings.Contains(log, line+"\n") {
+					t.Errorf("%q not in log:\n%s", line, log)
+				}
+			}
+			if len(test.logged) == 0 && log != "" {
+				t.Errorf("unexpected log:\n%s", log)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package proto
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// telnetCertificates returns the certificate each persona serves telnet
+// over TLS with: the configured one, or one made up for its hostname.
+func telnetCertificates(conf *Config) (map[string]tls.Certificate, error) {
+	certificates := map[string]tls.Certificate{}
+
+	if conf.TelnetTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TelnetTLSCert, conf.TelnetTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, persona := range personas {
+			certificates[persona] = cert
+		}
+		return certificates, nil
+	}
+
+	for _, persona := range personas {
+		cert, err := selfSignedCertificate(hostnames[persona])
+		if err != nil {
+			return nil, err
+		}
+		certificates[persona] = cert
+	}
+	return certificates, nil
+}
+
+// acceptTLS records the ClientHello of the client of conn, then completes
+// the handshake with cert.
+func acceptTLS(conn net.Conn, cert tls.Certificate, logFile *os.File) (*tls.Conn, error) {
+	// the whole record of the ClientHello has to fit to be peeked at
+	br := bufio.NewReaderSize(conn, 5+maxTLSRecord)
+
+	hello, err := peekClientHello(br)
+	if err != nil {
+		fmt.Fprint(logFile, "TlsClientHelloError:"+err.Error()+"\n")
+	} else {
+		fmt.Fprintf(logFile, "TlsClientHello:version=%#04x versions=%s ciphers=%s sni=%q alpn=%q\n", hello.version, hexList(hello.supportedVersions), hexList(hello.ciphers), hello.serverName, strings.Join(hello.alpn, ","))
+		ja3 := hello.ja3()
+		fmt.Fprintf(logFile, "TlsJA3:%x %s\n", md5.Sum([]byte(ja3)), ja3)
+	}
+
+	tlsConn := tls.Server(&bufferedConn{Conn: conn, r: br}, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+
+	err = tlsConn.Handshake()
+	if err != nil {
+		fmt.Fprint(logFile, "TlsHandshakeFailed:"+err.Error()+"\n")
+		return nil, err
+	}
+
+	state := tlsConn.ConnectionState()
+	fmt.Fprintf(logFile, "TlsHandshake:version=%#04x cipher=%#04x sni=%q\n", state.Version, state.CipherSuite, state.ServerName)
+	return tlsConn, nil
+}
+
+// largest TLS record, a ClientHello spread over several of them is not parsed.
+const maxTLSRecord = 16384
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+)
+
+// TLS extensions read from the ClientHello.
+const (
+	extServerName        = 0
+	extSupportedGroups   = 10
+	extECPointFormats    = 11
+	extALPN              = 16
+	extSupportedVersions = 43
+)
+
+// clientHello is what JA3 and the session log want of a ClientHello.
+type clientHello struct {
+	version           uint16
+	ciphers           []uint16
+	extensions        []uint16
+	curves            []uint16
+	pointFormats      []uint8
+	serverName        string
+	alpn              []string
+	supportedVersions []uint16
+}
+
+// peekClientHello parses the ClientHello at the start of br without
+// consuming it, crypto/tls reads it again for the handshake.
+func peekClientHello(br *bufio.Reader) (*clientHello, error) {
+	header, err := br.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != recordTypeHandshake {
+		return nil, fmt.Errorf("not a TLS handshake, starts with %q", header)
+	}
+	length := int(header[3])<<8 | int(header[4])
+	if length > maxTLSRecord {
+		return nil, errors.New("TLS record too long")
+	}
+	record, err := br.Peek(5 + length)
+	if err != nil {
+		return nil, err
+	}
+
+	s := cryptobyte.String(record[5:])
+	var msgType uint8
+	var msg cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != handshakeTypeClientHello || !s.ReadUint24LengthPrefixed(&msg) {
+		return nil, errors.New("not a ClientHello, or not in a single record")
+	}
+
+	h := &clientHello{}
+	var sessionID, ciphers, compression cryptobyte.String
+	if !msg.ReadUint16(&h.version) || !msg.Skip(32) ||
+		!msg.ReadUint8LengthPrefixed(&sessionID) ||
+		!msg.ReadUint16LengthPrefixed(&ciphers) ||
+		!msg.ReadUint8LengthPrefixed(&compression) {
+		return nil, errors.New("malformed ClientHello")
+	}
+	for !ciphers.Empty() {
+		var cipher uint16
+		if !ciphers.ReadUint16(&cipher) {
+			return nil, errors.New("malformed ClientHello cipher suites")
+		}
+		h.ciphers = append(h.ciphers, cipher)
+	}
+
+	if msg.Empty() {
+		// SSL 3.0 and some TLS 1.0 clients have no extensions
+		return h, nil
+	}
+	var extensions cryptobyte.String
+	if !msg.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("malformed ClientHello extensions")
+	}
+	for !extensions.Empty() {
+		var ext uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&ext) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("malformed ClientHello extensions")
+		}
+		h.extensions = append(h.extensions, ext)
+
+		// a malformed extension is left out, the handshake says the rest
+		switch ext {
+		case extServerName:
+			var names cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&names) {
+				continue
+			}
+			for !names.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+					break
+				}
+				if nameType == 0 {
+					h.serverName = string(name)
+				}
+			}
+		case extSupportedGroups:
+			var groups cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&groups) {
+				continue
+			}
+			for !groups.Empty() {
+				var group uint16
+				if !groups.ReadUint16(&group) {
+					break
+				}
+				h.curves = append(h.curves, group)
+			}
+		case extECPointFormats:
+			var formats cryptobyte.String
+			if !data.ReadUint8LengthPrefixed(&formats) {
+				continue
+			}
+			h.pointFormats = append(h.pointFormats, formats...)
+		case extALPN:
+			var protocols cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&protocols) {
+				continue
+			}
+			for !protocols.Empty() {
+				var protocol cryptobyte.String
+				if !protocols.ReadUint8LengthPrefixed(&protocol) {
+					break
+				}
+				h.alpn = append(h.alpn, string(protocol))
+			}
+		case extSupportedVersions:
+			var versions cryptobyte.String
+			if !data.ReadUint8LengthPrefixed(&versions) {
+				continue
+			}
+			for !versions.Empty() {
+				var version uint16
+				if !versions.ReadUint16(&version) {
+					break
+				}
+				h.supportedVersions = append(h.supportedVersions, version)
+			}
+		}
+	}
+	return h, nil
+}
+
+// ja3 is the JA3 string of the ClientHello: version, cipher suites,
+// extensions, groups and point formats, GREASE values left out.
+func (h *clientHello) ja3() string {
+	points := []uint16{}
+	for _, p := range h.pointFormats {
+		points = append(points, uint16(p))
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		decimalList(h.ciphers),
+		decimalList(h.extensions),
+		decimalList(h.curves),
+		decimalList(points),
+	}, ",")
+}
+
+// isGREASE tells whether v is one of the values of RFC 8701, 0x0a0a to
+// 0xfafa, that clients send to keep servers from choking on unknown ones.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func decimalList(values []uint16) string {
+	s := []string{}
+	for _, v := range values {
+		if !isGREASE(v) {
+			s = append(s, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(s, "-")
+}
+
+func hexList(values []uint16) string {
+	s := []string{}
+	for _, v := range values {
+		s = append(s, fmt.Sprintf("%#04x", v))
+	}
+	return strings.Join(s, ",")
+}
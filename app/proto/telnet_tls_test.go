@@ -0,0 +1,188 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// testClientHello is a ClientHello record with GREASE values among its
+// cipher suites, extensions, groups and versions, as Chrome sends them.
+func testClientHello() []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(recordTypeHandshake)
+	b.AddUint16(0x0301)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(handshakeTypeClientHello)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x0303)
+			b.AddBytes(make([]byte, 32))
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x0a0a)
+				b.AddUint16(0x1301)
+				b.AddUint16(0xc02f)
+			})
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x1a1a)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {})
+
+				b.AddUint16(extServerName)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint8(0)
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("example.com")) })
+					})
+				})
+
+				b.AddUint16(extSupportedGroups)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint16(0x2a2a)
+						b.AddUint16(29)
+						b.AddUint16(23)
+					})
+				})
+
+				b.AddUint16(extECPointFormats)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+				})
+
+				b.AddUint16(extALPN)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("h2")) })
+					})
+				})
+
+				b.AddUint16(extSupportedVersions)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddUint16(0x3a3a)
+						b.AddUint16(0x0304)
+						b.AddUint16(0x0303)
+					})
+				})
+			})
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func TestClientHelloJA3(t *testing.T) {
+	record := testClientHello()
+	br := bufio.NewReader(bytes.NewReader(record))
+
+	h, err := peekClientHello(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.Buffered() != len(record) {
+		t.Errorf("ClientHello consumed, %d bytes left of %d", br.Buffered(), len(record))
+	}
+	if h.serverName != "example.com" || len(h.alpn) != 1 || h.alpn[0] != "h2" {
+		t.Errorf("sni %q alpn %q", h.serverName, h.alpn)
+	}
+	if hexList(h.supportedVersions) != "0x3a3a,0x0304,0x0303" {
+		t.Errorf("versions %s", hexList(h.supportedVersions))
+	}
+
+	ja3 := h.ja3()
+	if ja3 != "771,4865-49199,0-10-11-16-43,29-23,0" {
+		t.Errorf("ja3 %q", ja3)
+	}
+	if sum := fmt.Sprintf("%x", md5.Sum([]byte(ja3))); sum != "ba56e367277299892e1a86aefd53de70" {
+		t.Errorf("ja3 md5 %s", sum)
+	}
+}
+
+// the ClientHello crypto/tls sends is parsed as it was configured
+func TestClientHelloCryptoTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{
+		ServerName:       "host.example.com",
+		NextProtos:       []string{"h2", "http/1.1"},
+		MaxVersion:       tls.VersionTLS12,
+		CipherSuites:     []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+	}).Handshake()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	h, err := peekClientHello(bufio.NewReaderSize(server, 5+maxTLSRecord))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.version != tls.VersionTLS12 || h.serverName != "host.example.com" {
+		t.Errorf("version %#04x sni %q", h.version, h.serverName)
+	}
+	if decimalList(h.curves) != "29-23" {
+		t.Errorf("curves %s", decimalList(h.curves))
+	}
+	// crypto/tls may add TLS_EMPTY_RENEGOTIATION_INFO_SCSV to those configured
+	if got := decimalList(h.ciphers); got != "49199-49200" && got != "49199-49200-255" {
+		t.Errorf("ciphers %s", got)
+	}
+	if len(h.alpn) != 2 || h.alpn[0] != "h2" || h.alpn[1] != "http/1.1" {
+		t.Errorf("alpn %q", h.alpn)
+	}
+}
+
+func TestClientHelloMalformed(t *testing.T) {
+	record := testClientHello()
+	body := append([]byte{}, record...)
+	// the handshake message claims more than the record holds
+	body[6], body[7], body[8] = 0, 0x40, 0
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"short header", record[:3]},
+		{"truncated record", record[:len(record)-10]},
+		{"not tls", []byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")},
+		{"telnet", []byte{255, 251, 1, 255, 251, 3}},
+		{"not a client hello", []byte{recordTypeHandshake, 3, 1, 0, 4, 2, 0, 0, 0}},
+		{"bad handshake length", body},
+		{"record too long", []byte{recordTypeHandshake, 3, 1, 0xff, 0xff}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := peekClientHello(bufio.NewReaderSize(bytes.NewReader(tt.input), 5+maxTLSRecord))
+			if err == nil {
+				t.Errorf("parsed as %+v", h)
+			}
+		})
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	// RFC 8701 reserves these 16 values, and only them
+	grease := map[uint16]bool{}
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0x2a2a, 0x3a3a, 0x4a4a, 0x5a5a, 0x6a6a, 0x7a7a, 0x8a8a, 0x9a9a, 0xaaaa, 0xbaba, 0xcaca, 0xdada, 0xeaea, 0xfafa} {
+		grease[v] = true
+	}
+	for v := 0; v <= 0xffff; v++ {
+		if isGREASE(uint16(v)) != grease[uint16(v)] {
+			t.Errorf("isGREASE(%#04x) = %t", v, !grease[uint16(v)])
+		}
+	}
+
+	if got := decimalList([]uint16{0x0a0a, 1, 0xfafa, 0x0a1a, 2}); got != "1-2586-2" {
+		t.Errorf("decimalList %q", got)
+	}
+}
@@ -0,0 +1,129 @@
+package proto
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Phases of a connection, each bounded by its own deadline.
+const (
+	phaseHandshake = "handshake"
+	phaseAuth      = "auth"
+	phaseSession   = "session"
+)
+
+// guardedConn enforces the handshake, authentication, idle and session
+// deadlines of a connection and remembers why it ended. The handshake and
+// authentication phases use a plain conn deadline, the session one is
+// refreshed by every read, and the absolute limit is a context.
+type guardedConn struct {
+	net.Conn
+
+	idleTimeout time.Duration
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu     sync.Mutex
+	phase  string
+	reason string
+	once   sync.Once
+}
+
+// newGuardedConn wraps conn, which is closed sessionTimeout from now at the latest.
+func newGuardedConn(conn net.Conn, sessionTimeout time.Duration) *guardedConn {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+
+	c := &guardedConn{
+		Conn:   conn,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			c.closeWith("session timeout")
+		}
+	}()
+
+	return c
+}
+
+// setPhase moves the connection to phase and starts that phase's deadline.
+// For the session phase, timeout is the idle timeout.
+func (c *guardedConn) setPhase(phase string, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.phase = phase
+	if phase == phaseSession {
+		// from now on reads push the idle deadline forward
+		c.idleTimeout = timeout
+		c.Conn.SetDeadline(time.Time{})
+		return
+	}
+	c.Conn.SetDeadline(time.Now().Add(timeout))
+}
+
+func (c *guardedConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	phase := c.phase
+	if phase == phaseSession {
+		c.Conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+	c.mu.Unlock()
+
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if phase == phaseSession {
+				c.closeWith("idle timeout")
+			} else {
+				c.closeWith(phase + " timeout")
+			}
+		} else if err == io.EOF {
+			c.setReason("client closed the connection")
+		}
+	}
+	return n, err
+}
+
+func (c *guardedConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.setReason("server closed the connection")
+		c.cancel()
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// closeWith closes the connection, recording reason unless an earlier one is known.
+func (c *guardedConn) closeWith(reason string) {
+	c.setReason(reason)
+	err := c.Close()
+	if err != nil {
+		log.Print("close failed:", err.Error()+"\n")
+	}
+}
+
+func (c *guardedConn) setReason(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reason == "" {
+		c.reason = reason
+	}
+}
+
+// closeReason tells why the connection ended, or why it is ending.
+func (c *guardedConn) closeReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reason
+}
@@ -0,0 +1,122 @@
+package proto
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const testTimeout = 50 * time.Millisecond
+
+// newTestGuard guards the server end of a pipe, returning the client end.
+func newTestGuard(t *testing.T, sessionTimeout time.Duration) (*guardedConn, net.Conn) {
+	client, server := net.Pipe()
+	guard := newGuardedConn(server, sessionTimeout)
+	t.Cleanup(func() {
+		client.Close()
+		guard.Close()
+	})
+	return guard, client
+}
+
+// expectClosed reads from guard until it fails, then checks that the
+// connection ended for reason and that the client saw it close.
+func expectClosed(t *testing.T, guard *guardedConn, client net.Conn, reason string) {
+	t.Helper()
+	buf := make([]byte, 16)
+	for {
+		if _, err := guard.Read(buf); err != nil {
+			break
+		}
+	}
+	if guard.closeReason() != reason {
+		t.Errorf("closed for %q, want %q", guard.closeReason(), reason)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Errorf("client read %v after the close, want EOF", err)
+	}
+}
+
+func TestGuardedConnPhaseTimeouts(t *testing.T) {
+	for _, phase := range []string{phaseHandshake, phaseAuth} {
+		guard, client := newTestGuard(t, time.Hour)
+		guard.setPhase(phase, testTimeout)
+
+		start := time.Now()
+		expectClosed(t, guard, client, phase+" timeout")
+		if elapsed := time.Since(start); elapsed < testTimeout {
+			t.Errorf("%s closed after %s", phase, elapsed)
+		}
+	}
+}
+
+func TestGuardedConnAuthAfterHandshake(t *testing.T) {
+	guard, client := newTestGuard(t, time.Hour)
+	guard.setPhase(phaseHandshake, testTimeout)
+	// a phase starts its own deadline, the handshake one is gone
+	guard.setPhase(phaseAuth, 4*testTimeout)
+
+	start := time.Now()
+	expectClosed(t, guard, client, "auth timeout")
+	if elapsed := time.Since(start); elapsed < 4*testTimeout {
+		t.Errorf("closed after %s", elapsed)
+	}
+}
+
+func TestGuardedConnIdleTimeout(t *testing.T) {
+	guard, client := newTestGuard(t, time.Hour)
+	guard.setPhase(phaseSession, 2*testTimeout)
+
+	// traffic more often than the idle timeout keeps the session going
+	// well past it
+	go func() {
+		for i := 0; i < 8; i++ {
+			client.Write([]byte{'x'})
+			time.Sleep(testTimeout / 2)
+		}
+	}()
+	start := time.Now()
+	buf := make([]byte, 1)
+	for i := 0; i < 8; i++ {
+		if _, err := guard.Read(buf); err != nil {
+			t.Fatalf("read %d failed after %s: %v", i, time.Since(start), err)
+		}
+	}
+
+	last := time.Now()
+	expectClosed(t, guard, client, "idle timeout")
+	if elapsed := time.Since(last); elapsed < 2*testTimeout {
+		t.Errorf("closed %s after the last read", elapsed)
+	}
+}
+
+func TestGuardedConnSessionTimeout(t *testing.T) {
+	guard, client := newTestGuard(t, 2*testTimeout)
+	guard.setPhase(phaseSession, time.Hour)
+
+	// the absolute limit holds however busy the session is
+	go func() {
+		for {
+			if _, err := client.Write([]byte{'x'}); err != nil {
+				return
+			}
+			time.Sleep(testTimeout / 5)
+		}
+	}()
+	expectClosed(t, guard, client, "session timeout")
+}
+
+func TestGuardedConnClientClose(t *testing.T) {
+	guard, client := newTestGuard(t, time.Hour)
+	guard.setPhase(phaseSession, time.Hour)
+
+	client.Close()
+	if _, err := guard.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %v, want EOF", err)
+	}
+	if guard.closeReason() != "client closed the connection" {
+		t.Errorf("closed for %q", guard.closeReason())
+	}
+}